@@ -0,0 +1,129 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	accessLogPath    = flag.String("accessLog", "", "access log file path, empty means disabled")
+	accessLogMaxSize = flag.Int64("accessLogMaxSize", 100, "rotate access log when it's larger than this size(MB)")
+	accessLogBackups = flag.Int("accessLogBackups", 7, "how many rotated access log files to keep")
+)
+
+// Entry is a record of a tunneled connection
+type Entry struct {
+	Source     string    `json:"source,omitempty"` // source address of the connection from WAN
+	Tunnel     string    `json:"tunnel"`           // public address of the tunnel
+	Token      string    `json:"token,omitempty"`  // hash of token
+	Local      string    `json:"local,omitempty"`  // local target address, only for client
+	Start      time.Time `json:"start"`            // when the connection started
+	DurationMS int64     `json:"duration_ms"`      // how long the connection lasted
+	BytesIn    int64     `json:"bytes_in"`         // bytes from WAN to local
+	BytesOut   int64     `json:"bytes_out"`        // bytes from local to WAN
+	Reason     string    `json:"reason"`           // why the connection closed
+}
+
+// Logger writes entries into a file, one json per line, and rotates the file by size
+type Logger struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// Open returns a Logger configured by command line flags, or nil if access log is disabled
+func Open() (*Logger, error) {
+	if *accessLogPath == "" {
+		return nil, nil
+	}
+
+	return New(*accessLogPath, *accessLogMaxSize*1024*1024, *accessLogBackups)
+}
+
+// New returns a Logger writes to path
+func New(path string, maxSize int64, backups int) (*Logger, error) {
+	l := &Logger{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// path -> path.1 -> path.2 ... the oldest one will be removed
+func (l *Logger) rotate() error {
+	l.file.Close()
+
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.backups))
+	for i := l.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.backups > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+
+	return l.open()
+}
+
+// Write an entry, it's safe to call on a nil Logger
+func (l *Logger) Write(entry *Entry) error {
+	if l == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxSize > 0 && l.size+int64(len(data)) > l.maxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// Close the log file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.file.Close()
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"flag"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/dial"
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/logger"
+)
+
+// 选择本地后端的策略
+const (
+	lbRoundRobin = "roundrobin"
+	lbLeastConn  = "leastconn"
+	lbFirst      = "first"
+
+	localDialTimeout = time.Second * 5
+)
+
+var (
+	lbPolicy       = flag.String("lb", lbRoundRobin, "-lb=roundrobin|leastconn|first -local有多个地址时选择后端的策略")
+	healthInterval = flag.Duration("healthInterval", time.Second*10, "-healthInterval=10s -local有多个地址时检查后端是否可用的间隔，0表示不检查")
+	healthTimeout  = flag.Duration("healthTimeout", time.Second*2, "-healthTimeout=2s 检查后端是否可用的超时时间")
+)
+
+type backend struct {
+	addr    string
+	healthy int32 // 1表示可用
+	active  int64 // 正在转发的连接数
+}
+
+// 多个本地后端，按策略选择，连接失败时依次尝试下一个
+type backendPool struct {
+	policy   string
+	backends []*backend
+	next     uint32
+	checking bool // 是否在做健康检查，不检查的话后端不会被标记为不可用
+}
+
+func newBackendPool(addrs, policy string) (*backendPool, error) {
+	if policy != lbRoundRobin && policy != lbLeastConn && policy != lbFirst {
+		return nil, errors.ErrNotSupport
+	}
+
+	pool := &backendPool{policy: policy}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			pool.backends = append(pool.backends, &backend{addr: addr, healthy: 1})
+		}
+	}
+	if len(pool.backends) == 0 {
+		return nil, errors.ErrNoBackend
+	}
+
+	return pool, nil
+}
+
+// 按策略排好序的后端，不可用的放在最后，全部不可用时也还会尝试
+func (p *backendPool) candidates() []*backend {
+	var healthy, unhealthy []*backend
+	for _, b := range p.backends {
+		if atomic.LoadInt32(&b.healthy) == 1 {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+
+	switch p.policy {
+	case lbRoundRobin:
+		if n := len(healthy); n > 1 {
+			start := int(atomic.AddUint32(&p.next, 1) % uint32(n))
+			healthy = append(healthy[start:], healthy[:start]...)
+		}
+	case lbLeastConn:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return atomic.LoadInt64(&healthy[i].active) < atomic.LoadInt64(&healthy[j].active)
+		})
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// 连接一个本地后端
+func (p *backendPool) dial() (net.Conn, string, error) {
+	err := errors.ErrNoBackend
+	for _, b := range p.candidates() {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", b.addr, localDialTimeout)
+		if err != nil {
+			logger.Warn("无法连接本地后端", "local", b.addr, "error", err)
+			if p.checking {
+				p.setHealthy(b, false)
+			}
+			continue
+		}
+
+		atomic.AddInt64(&b.active, 1)
+		return &backendConn{Conn: conn, backend: b}, b.addr, nil
+	}
+
+	return nil, "", err
+}
+
+func (p *backendPool) setHealthy(b *backend, healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&b.healthy, v) != v {
+		if healthy {
+			logger.Info("本地后端恢复可用", "local", b.addr)
+		} else {
+			logger.Warn("本地后端不可用，暂停转发", "local", b.addr)
+		}
+	}
+}
+
+// 定期检查后端能否连接
+func (p *backendPool) startHealthCheck(interval, timeout time.Duration, stopCh <-chan struct{}) {
+	p.checking = true
+	go p.healthCheck(interval, timeout, stopCh)
+}
+
+func (p *backendPool) healthCheck(interval, timeout time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+
+		var wait sync.WaitGroup
+		for _, b := range p.backends {
+			wait.Add(1)
+			go func(b *backend) {
+				defer wait.Done()
+
+				conn, err := net.DialTimeout("tcp", b.addr, timeout)
+				if err == nil {
+					conn.Close()
+				}
+				p.setHealthy(b, err == nil)
+			}(b)
+		}
+		wait.Wait()
+	}
+}
+
+// 关闭时减少后端的连接数
+type backendConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+// Unwrap returns the conn to the backend, so dial.Join can use splice
+func (c *backendConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *backendConn) CloseWrite() error {
+	return dial.CloseWrite(c.Conn)
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.backend.active, -1) })
+	return c.Conn.Close()
+}
@@ -2,19 +2,30 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"flag"
-	"log"
 	"net"
+	"net/http"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/protobuf/proto"
+	"github.com/jiajunhuang/natproxy/accesslog"
+	"github.com/jiajunhuang/natproxy/compression"
 	"github.com/jiajunhuang/natproxy/dial"
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/inspector"
+	"github.com/jiajunhuang/natproxy/logger"
 	"github.com/jiajunhuang/natproxy/pb"
+	"github.com/jiajunhuang/natproxy/protocol"
+	"github.com/jiajunhuang/natproxy/proxyproto"
 	"github.com/jiajunhuang/natproxy/tools"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 const (
@@ -23,18 +34,48 @@ const (
 	os      = runtime.GOOS
 )
 
+// 重连服务器的等待时间，连续失败时翻倍
+const (
+	minRetryInterval = time.Second * 5
+	maxRetryInterval = time.Minute * 2
+)
+
 var (
-	localAddr        = flag.String("local", "127.0.0.1:8080", "-local=<你本地需要转发的地址>")
-	serverAddr       = flag.String("server", "natproxy.laizuoceshi.com:8443", "-server=<你的服务器地址>")
-	token            = flag.String("token", "", "-token=<你的token>")
+	localAddr        = flag.String("local", "127.0.0.1:8080", "-local=<你本地需要转发的地址> 多个地址用逗号分隔")
+	serverAddr       = flag.String("server", "natproxy.laizuoceshi.com:8443", "-server=<你的服务器地址> 多个地址用逗号分隔，可以用@指定优先级，如a:8443@0,b:8443@1，越小越优先")
+	token            = flag.String("token", "", "-token=<你的token> 会出现在ps的输出里，建议用natproxy login保存或者用-tokenFile")
 	useTLS           = flag.Bool("tls", true, "-tls=true 默认使用TLS加密")
+	dataTLS          = flag.Bool("dataTLS", true, "-dataTLS=true 控制通道使用TLS时，转发的数据也使用TLS加密。关闭并且不压缩时，Linux上转发的数据可以用splice在内核里复制")
+	tunnelType       = flag.String("type", "tcp", "-type=tcp|http 隧道类型，http隧道会由服务器解析请求并添加X-Forwarded-*头部")
+	httpHost         = flag.String("httpHost", "", "-httpHost=<改写后的Host头部> 仅http隧道有效")
+	httpAuth         = flag.String("httpAuth", "", "-httpAuth=<用户名:密码> 访问http隧道需要basic auth认证")
+	httpBearer       = flag.String("httpBearer", "", "-httpBearer=<token> 访问http隧道需要bearer token认证")
+	inspectAddr      = flag.String("inspect", "", "-inspect=127.0.0.1:4040 开启http隧道的请求检查，在该地址提供网页和JSON API")
+	inspectMax       = flag.Int("inspectMax", 100, "-inspectMax=100 请求检查最多保留的请求数")
+	allowCIDR        = flag.String("allow", "", "-allow=<CIDR列表，逗号分隔> 只允许这些网段访问公网地址")
+	denyCIDR         = flag.String("deny", "", "-deny=<CIDR列表，逗号分隔> 禁止这些网段访问公网地址")
+	proxyProtocol    = flag.String("proxyProtocol", "", "-proxyProtocol=v1|v2 向本地服务发送PROXY protocol头部，默认不发送")
+	compress         = flag.String("compress", "", "-compress=snappy|zstd 压缩转发的数据，需要服务器同意，默认不压缩")
+	group            = flag.String("group", "", "-group=<分组名> 同一个token下同一分组的客户端共享公网地址，服务器把公网连接分给组内所有客户端")
+	dialTimeout      = flag.Duration("dialTimeout", time.Second*10, "-dialTimeout=10s 连接服务器的超时时间，包括TLS握手")
+	idleTimeout      = flag.Duration("idleTimeout", 0, "-idleTimeout=10m 连接上这么久没有数据就关闭，默认不关闭")
+	keepAlive        = flag.Duration("keepAlive", time.Second*30, "-keepAlive=30s TCP keepalive间隔，负数表示关闭keepalive")
+	noDelay          = flag.Bool("noDelay", true, "-noDelay=true 设置TCP_NODELAY，关闭后小的数据包会合并发送")
+	readBuffer       = flag.Int("readBuffer", 0, "-readBuffer=<字节数> socket接收缓冲区大小，默认由系统决定")
+	writeBuffer      = flag.Int("writeBuffer", 0, "-writeBuffer=<字节数> socket发送缓冲区大小，默认由系统决定")
+	connIdleTimeout  = flag.Duration("connIdleTimeout", 0, "-connIdleTimeout=5m 转发的连接两个方向都没有数据这么久就关闭，默认不关闭")
+	connMaxLifetime  = flag.Duration("connMaxLifetime", 0, "-connMaxLifetime=24h 转发的连接最长存活时间，默认不限制")
+	connHalfClose    = flag.Duration("connHalfCloseTimeout", 0, "-connHalfCloseTimeout=1m 转发的连接一个方向结束之后，另一个方向这么久还没结束就关闭，0表示1分钟，负数表示不限制")
+	pingInterval     = flag.Duration("pingInterval", time.Second*30, "-pingInterval=30s 服务器支持时每隔这么久发送心跳，3倍时间没有收到服务器的消息就重连，超过服务器心跳超时的1/3时自动缩短，0表示不发送")
+	failbackInterval = flag.Duration("failbackInterval", time.Minute, "-failbackInterval=1m 连在备用服务器上时，每隔这么久探测优先级更高的服务器，恢复后切回去，0表示不切回")
 	clientDisconnect int32
+	accessLog        *accesslog.Logger
 )
 
 func checkAnnoncements() {
 	annoncement := tools.GetAnnouncement()
 	if annoncement != "" {
-		log.Printf("最新公告: %s", annoncement)
+		logger.Info("最新公告", "announcement", annoncement)
 	}
 }
 
@@ -43,10 +84,10 @@ func checkClientStatus() {
 		func() {
 			disconnect, err := tools.GetConnectionStatusByToken(*token)
 			if err != nil {
-				log.Printf("无法连接服务器: %s", err)
+				logger.Error("无法连接服务器", "error", err)
 				return
 			}
-			log.Printf("检查当前服务端是否已经把本账号设置成断开连接: %t", disconnect)
+			logger.Debug("检查当前服务端是否已经把本账号设置成断开连接", "disconnect", disconnect)
 			if disconnect == true {
 				atomic.StoreInt32(&clientDisconnect, 1)
 			} else {
@@ -58,111 +99,348 @@ func checkClientStatus() {
 	}
 }
 
-func connectServer(stream pb.ServerService_MsgClient, addr string) {
+func (t *tunnel) connectServer(stream pb.ServerService_MsgClient, msg *pb.ConnectRequest, wanAddr string, tlsConfig *tls.Config, algo string) {
+	addr := msg.Addr
+
 	if atomic.LoadInt32(&clientDisconnect) == 1 {
-		if err := stream.Send(&pb.MsgRequest{Type: pb.MsgType_DisConnect}); err != nil {
-			log.Printf("无法发送消息到服务器: %s", err)
+		if err := send(stream, &pb.MsgRequest{Payload: &pb.MsgRequest_Disconnect{Disconnect: &pb.Disconnect{}}}); err != nil {
+			logger.Error("无法发送消息到服务器", "error", err)
 			return
 		}
-		log.Printf("服务端已经设置为拒绝连接")
+		logger.Warn("服务端已经设置为拒绝连接")
 		return
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = t.config.Socket.DialTLS("tcp", addr, tlsConfig)
+	} else {
+		conn, err = t.config.Socket.Dial("tcp", addr)
+	}
 	if err != nil {
-		log.Printf("无法连接服务器(服务器地址%s): %s", addr, err)
+		logger.Error("无法连接服务器", "addr", addr, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// 告诉服务器这个连接对应哪个公网连接
+	if msg.ConnId != 0 {
+		if err := binary.Write(conn, binary.BigEndian, msg.ConnId); err != nil {
+			logger.Error("无法发送连接编号", "error", err)
+			return
+		}
+	}
+	if conn, err = compression.Wrap(conn, algo); err != nil {
+		logger.Error("无法启用压缩", "compress", algo, "error", err)
 		return
 	}
 	defer conn.Close()
 
-	localConn, err := net.Dial("tcp", *localAddr)
+	localConn, local, err := t.backends.dial()
 	if err != nil {
-		log.Printf("无法连接本地目标地址(%s): %s", *localAddr, err)
+		logger.Error("无法连接本地目标地址", "local", t.config.Local, "error", err)
 		return
 	}
 	defer localConn.Close()
 
-	dial.Join(conn, localConn)
+	// 通过PROXY protocol把公网来源地址告诉本地服务
+	if t.config.ProxyProtocol != "" {
+		src, dst := proxyproto.ParseTCPAddr(msg.SrcAddr), proxyproto.ParseTCPAddr(msg.DstAddr)
+		if err := proxyproto.WriteHeader(localConn, t.config.ProxyProtocol, src, dst); err != nil {
+			logger.Error("无法写入PROXY protocol头部", "error", err)
+			return
+		}
+	}
+
+	start := time.Now()
+	var stats dial.Stats
+	if t.inspect != nil {
+		stats = inspectHTTP(t.inspect, conn, localConn, t.config.Join)
+	} else {
+		stats = dial.JoinWith(conn, localConn, t.config.Join)
+	}
+
+	reason := "local closed"
+	if stats.Closer == conn {
+		reason = "server closed"
+	}
+	if stats.Err != nil {
+		reason = stats.Err.Error()
+	}
+	err = accessLog.Write(&accesslog.Entry{
+		Source:     msg.SrcAddr,
+		Tunnel:     wanAddr,
+		Local:      local,
+		Start:      start,
+		DurationMS: int64(time.Since(start) / time.Millisecond),
+		BytesIn:    stats.OutCount,
+		BytesOut:   stats.InCount,
+		Reason:     reason,
+	})
+	if err != nil {
+		logger.Warn("无法写入访问日志", "error", err)
+	}
 }
 
-func waitMsgFromServer(addr string) error {
-	log.Printf("准备连接到服务器(%s)...", *serverAddr)
+func (t *tunnel) waitMsgFromServer(addr string, failback <-chan struct{}) error {
+	logger.Info("准备连接到服务器", "tunnel_name", t.config.Name, "server", addr)
 
-	md := metadata.Pairs("natproxy-token", *token)
-	ctx := metadata.NewOutgoingContext(context.Background(), md)
+	config := t.config
+	md := metadata.Pairs("natproxy-token", *token, "natproxy-conn-id", "1", "natproxy-tunnel-type", config.Type)
+	if config.Allow != "" || config.Deny != "" {
+		md.Set("natproxy-allow", config.Allow)
+		md.Set("natproxy-deny", config.Deny)
+	}
+	if *useTLS && *dataTLS {
+		md.Set("natproxy-data-tls", "1")
+	}
+	if config.Compress != "" {
+		md.Set("natproxy-compress", config.Compress)
+	}
+	if config.Group != "" {
+		md.Set("natproxy-group", config.Group)
+	}
+	// 同一个token的其他隧道各自分配公网端口，默认隧道使用token的公网地址
+	if config.Name != defaultTunnel {
+		md.Set("natproxy-tunnel-name", config.Name)
+	}
+	if config.Type == "http" {
+		md.Set("natproxy-http-host", config.HTTPHost)
+		md.Set("natproxy-http-auth", config.HTTPAuth)
+		md.Set("natproxy-http-bearer", config.HTTPBearer)
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), md))
+	defer cancel()
 
-	client, conn, err := dial.WithServer(ctx, *serverAddr, *useTLS)
+	// 隧道被删除或者要切回优先级更高的服务器时断开控制连接
+	go func() {
+		select {
+		case <-t.stopCh:
+			cancel()
+		case <-failback:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client, conn, err := dial.WithServer(ctx, addr, *useTLS)
 	if err != nil {
-		log.Printf("无法连接服务器: %s", err)
+		logger.Error("无法连接服务器", "error", err)
 		return err
 	}
 	defer conn.Close()
 
 	stream, err := client.Msg(ctx)
 	if err != nil {
-		log.Printf("无法与服务器通信: %s", err)
+		logger.Error("无法与服务器通信", "error", err)
 		return err
 	}
-	log.Printf("成功连接到服务器(%s)", *serverAddr)
+	logger.Info("成功连接到服务器", "server", addr)
 
-	// report client version info
-	data, err := proto.Marshal(&pb.ClientInfo{Os: os, Arch: arch, Version: version})
-	if err != nil {
-		log.Printf("无法压缩信息: %s", err)
+	// 数据连接只接受和控制通道相同的证书
+	var tlsConfig *tls.Config
+	if *useTLS && *dataTLS {
+		p, ok := peer.FromContext(stream.Context())
+		if !ok {
+			return errors.ErrCertMismatch
+		}
+		tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+			return errors.ErrCertMismatch
+		}
+		tlsConfig = dial.PinnedTLSConfig(tlsInfo.State.PeerCertificates[0].Raw)
+	}
+
+	// 握手，告诉服务器协议版本和支持的功能
+	hs := &pb.HandshakeInfo{ProtocolVersion: protocol.Version, Features: clientFeatures()}
+	if err := send(stream, &pb.MsgRequest{Payload: &pb.MsgRequest_Handshake{Handshake: hs}}); err != nil {
+		logger.Error("无法发送消息到服务器", "error", err)
 		return err
 	}
-	if err := stream.Send(&pb.MsgRequest{Type: pb.MsgType_Report, Data: data}); err != nil {
-		log.Printf("无法发送消息到服务器: %s", err)
+
+	// report client version info
+	info := &pb.ClientInfo{Os: os, Arch: arch, Version: version}
+	if err := send(stream, &pb.MsgRequest{Payload: &pb.MsgRequest_Report{Report: info}}); err != nil {
+		logger.Error("无法发送消息到服务器", "error", err)
 		return err
 	}
 
+	// 以服务器返回的压缩算法为准，旧版本服务器不会返回，即不压缩。服务器收到握手之后才发送响应头
+	algo := compression.None
+	if config.Compress != "" {
+		header, err := stream.Header()
+		if err != nil {
+			logger.Error("无法读取服务器响应头", "error", err)
+			return err
+		}
+		if values := header.Get("natproxy-compress"); len(values) > 0 {
+			algo = values[0]
+		}
+		if !compression.Supported(algo) {
+			return errors.ErrNotSupport
+		}
+		if algo != config.Compress {
+			logger.Warn("服务器不同意压缩，数据将不压缩传输", "compress", config.Compress)
+		}
+	}
+
+	var wanAddr string
+	var features []string // 旧版本服务器没有握手，什么功能都不支持
+	hb := newHeartbeat(cancel)
+	defer hb.stop()
 	for {
 		resp, err := stream.Recv()
 		if err != nil {
-			log.Printf("无法从服务器接收消息: %s", err)
+			if hb.timedOut() {
+				logger.Error("服务器没有回应心跳", "timeout", hb.timeout())
+				return errors.ErrHeartbeatTimeout
+			}
+			logger.Error("无法从服务器接收消息", "error", err)
 			return err
 		}
+		hb.received()
 
-		switch resp.Type {
-		case pb.MsgType_Connect:
-			log.Printf("服务器要求发起新连接至%s", resp.Data)
-			go connectServer(stream, string(resp.Data))
-		case pb.MsgType_WANAddr:
-			log.Printf("服务器分配的公网地址是%s", resp.Data)
+		// 旧版本服务器只发送旧的消息格式
+		if resp, err = resp.Typed(); err != nil {
+			logger.Error("无法解析服务器消息", "error", err)
+			return err
+		}
+
+		switch payload := resp.Payload.(type) {
+		case *pb.MsgResponse_Connect:
+			logger.Debug("服务器要求发起新连接", "addr", payload.Connect.Addr)
+			dataTLSConfig, dataAlgo := tlsConfig, algo
+			if !protocol.Has(features, protocol.FeatureDataTLS) {
+				dataTLSConfig = nil
+			}
+			if !protocol.Has(features, protocol.FeatureCompression) {
+				dataAlgo = compression.None
+			}
+			go t.connectServer(stream, payload.Connect, wanAddr, dataTLSConfig, dataAlgo)
+		case *pb.MsgResponse_WanAddr:
+			wanAddr = payload.WanAddr.Addr
+			t.setStatus(tunnelOnline, addr, wanAddr, nil)
+			logger.Info("服务器分配的公网地址", "tunnel_name", config.Name, "server", addr, "tunnel", wanAddr)
+		case *pb.MsgResponse_Reconnect:
+			logger.Info("服务器即将停止服务，准备重新连接")
+			return errors.ErrServerShuttingDown
+		case *pb.MsgResponse_Handshake:
+			hs := payload.Handshake
+			if hs.Reason != "" {
+				logger.Error("服务器拒绝连接", "reason", hs.Reason)
+				return errors.ErrClientTooOld
+			}
+			features = hs.Features
+			logger.Info("握手成功", "protocol_version", hs.ProtocolVersion, "features", strings.Join(features, ","))
+			if protocol.Has(features, protocol.FeatureHeartbeat) {
+				hb.setServerTimeout(time.Duration(hs.HeartbeatTimeoutMs) * time.Millisecond)
+				go hb.run(stream)
+			}
+		case *pb.MsgResponse_Error:
+			info := payload.Error
+			logger.Error("服务器返回错误", "code", info.Code, "error", info.Message, "retryable", info.Retryable)
+			return newServerError(info)
+		case *pb.MsgResponse_Ping:
+			logger.Debug("收到服务器的pong", "rtt", time.Since(time.Unix(0, payload.Ping.UnixNano)))
 		default:
-			log.Printf("当前版本客户端不支持本消息(%s)，请升级", resp.Data)
+			logger.Warn("当前版本客户端不支持本消息，请升级", "msg_type", resp.Type)
 		}
 	}
 }
 
+// stream.Send不能并发调用，心跳和发起连接的goroutine都会发送消息
+var sendLock sync.Mutex
+
+// 发送消息给服务器，同时带上旧的消息格式，旧版本服务器也能看懂
+func send(stream pb.ServerService_MsgClient, msg *pb.MsgRequest) error {
+	msg, err := msg.WithLegacy()
+	if err != nil {
+		return err
+	}
+
+	sendLock.Lock()
+	defer sendLock.Unlock()
+	return stream.Send(msg)
+}
+
 // Start client
-func Start(connect, disconnect bool) {
+func Start() {
+	loadToken()
 	if *token == "" {
-		log.Printf("token不能为空")
+		logger.Error("token不能为空，请先运行natproxy login，或者用-tokenFile、环境变量NATPROXY_TOKEN指定")
 		return
 	}
 
-	if disconnect {
-		err := tools.Disconnect(*token, true)
-		log.Printf("通知服务器将本客户端设置为断开连接结果: %s", err)
+	var err error
+	if accessLog, err = accesslog.Open(); err != nil {
+		logger.Error("无法打开访问日志", "error", err)
 		return
 	}
-	if connect {
-		err := tools.Disconnect(*token, false)
-		log.Printf("通知服务器将本客户端设置为正常连接结果: %s", err)
+	defer accessLog.Close()
+
+	d := newDaemon()
+
+	// -local为空时只启动控制接口，隧道之后再添加
+	if *localAddr != "" {
+		t, err := newTunnel(configFromFlags(defaultTunnel))
+		if err != nil {
+			logger.Error("隧道配置不对", "local", *localAddr, "type", *tunnelType, "lb", *lbPolicy, "server", *serverAddr, "error", err)
+			return
+		}
+		if *inspectAddr != "" {
+			if *tunnelType != "http" {
+				logger.Error("只有http隧道才能开启请求检查")
+				return
+			}
+			t.inspect = inspector.New(t.backends.backends[0].addr, *inspectMax)
+			t.inspect.SetDial(func() (net.Conn, error) {
+				conn, _, err := t.backends.dial()
+				return conn, err
+			})
+			go func() {
+				logger.Info("请求检查已开启", "addr", *inspectAddr)
+				if err := http.ListenAndServe(*inspectAddr, t.inspect); err != nil {
+					logger.Error("无法启动请求检查", "error", err)
+				}
+			}()
+		}
+		d.add(t)
+	} else if *controlSocket == "" {
+		logger.Error("-local和-control不能都为空")
 		return
 	}
 
+	if *controlSocket != "" {
+		listener, err := listenControl(*controlSocket)
+		if err != nil {
+			logger.Error("无法启动控制接口", "control", *controlSocket, "error", err)
+			return
+		}
+		defer listener.Close()
+
+		logger.Info("控制接口已开启", "control", *controlSocket)
+		go http.Serve(listener, d)
+	}
+
 	go checkClientStatus()
 	go checkAnnoncements()
 
-	for {
-		err := waitMsgFromServer(*serverAddr)
-		errMsg := err.Error()
-		if strings.Contains(errMsg, "token not valid") {
-			log.Printf("您的token不对，请检查是否正确配置，参考：https://jiajunhuang.com/natproxy")
-			break
-		}
-		time.Sleep(time.Second * 5)
+	<-d.exitCh
+}
+
+// SetDisconnect tells the server whether to reject connections of this token
+func SetDisconnect(disconnect bool) {
+	loadToken()
+	if *token == "" {
+		logger.Error("token不能为空，请先运行natproxy login，或者用-tokenFile、环境变量NATPROXY_TOKEN指定")
+		return
+	}
+
+	err := tools.Disconnect(*token, disconnect)
+	if disconnect {
+		logger.Info("通知服务器将本客户端设置为断开连接", "error", err)
+	} else {
+		logger.Info("通知服务器将本客户端设置为正常连接", "error", err)
 	}
 }
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+const controlTimeout = time.Second * 10
+
+// 通过unix socket访问正在运行的客户端
+var controlClient = &http.Client{
+	Timeout: controlTimeout,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", *controlSocket)
+		},
+	},
+}
+
+func control(method, path string, body, result interface{}) error {
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://natproxy"+path, &reader)
+	if err != nil {
+		return err
+	}
+	resp, err := controlClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.ErrBadRequest
+		}
+		return fmt.Errorf("正在运行的客户端返回错误: %s", e.Error)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// GetStatus returns the status of the running client
+func GetStatus() (*Status, error) {
+	status := &Status{}
+	if err := control(http.MethodGet, "/status", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// AddTunnel adds a tunnel to the running client, config of the tunnel is read from flags
+func AddTunnel(name string) (*TunnelStatus, error) {
+	status := &TunnelStatus{}
+	if err := control(http.MethodPost, "/tunnels", configFromFlags(name), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// RemoveTunnel removes a tunnel from the running client
+func RemoveTunnel(name string) error {
+	return control(http.MethodDelete, "/tunnels/"+url.PathEscape(name), nil, nil)
+}
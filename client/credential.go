@@ -0,0 +1,141 @@
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	sysos "os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/jiajunhuang/natproxy/logger"
+)
+
+// 保存token的环境变量
+const tokenEnv = "NATPROXY_TOKEN"
+
+var tokenFile = flag.String("tokenFile", "", "-tokenFile=<文件路径> 从文件读取token，文件里只有token")
+
+// Credential is saved by natproxy login
+type Credential struct {
+	Email string `json:"email,omitempty"`
+	Token string `json:"token"`
+}
+
+// 按用户保存配置的目录
+func configDir() (string, error) {
+	if runtime.GOOS == "windows" {
+		if dir := sysos.Getenv("AppData"); dir != "" {
+			return filepath.Join(dir, "natproxy"), nil
+		}
+	}
+	if dir := sysos.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "natproxy"), nil
+	}
+	home, err := sysos.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "natproxy"), nil
+}
+
+// CredentialPath returns the path of the credential file of current user
+func CredentialPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "credential.json"), nil
+}
+
+// SaveCredential saves the credential so the client loads token automatically, only current
+// user can read it
+func SaveCredential(cred *Credential) (string, error) {
+	path, err := CredentialPath()
+	if err != nil {
+		return "", err
+	}
+	if err := sysos.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(cred, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return "", err
+	}
+	// WriteFile不会修改已经存在的文件的权限
+	if err := sysos.Chmod(tmp, 0600); err != nil {
+		return "", err
+	}
+	return path, sysos.Rename(tmp, path)
+}
+
+// RemoveCredential removes the saved credential
+func RemoveCredential() (string, error) {
+	path, err := CredentialPath()
+	if err != nil {
+		return "", err
+	}
+	if err := sysos.Remove(path); err != nil && !sysos.IsNotExist(err) {
+		return "", err
+	}
+	return path, nil
+}
+
+// 读取token文件，其他用户可以读的话提醒一下
+func readTokenFile(path string) (string, error) {
+	if info, err := sysos.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		logger.Warn("token文件其他用户也可以读取，建议改为只有自己可读写", "file", path, "mode", info.Mode().Perm())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// 依次从-token、环境变量、-tokenFile、natproxy login保存的文件中读取token
+func loadToken() {
+	if *token != "" {
+		return
+	}
+
+	if t := sysos.Getenv(tokenEnv); t != "" {
+		*token = t
+		return
+	}
+
+	if *tokenFile != "" {
+		t, err := readTokenFile(*tokenFile)
+		if err != nil {
+			logger.Error("无法读取token文件", "file", *tokenFile, "error", err)
+			return
+		}
+		*token = t
+		return
+	}
+
+	path, err := CredentialPath()
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !sysos.IsNotExist(err) {
+			logger.Error("无法读取登录信息", "file", path, "error", err)
+		}
+		return
+	}
+	cred := &Credential{}
+	if err := json.Unmarshal(data, cred); err != nil {
+		logger.Error("登录信息格式不对，请重新登录", "file", path, "error", err)
+		return
+	}
+	*token = cred.Token
+}
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	sysos "os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/logger"
+	"github.com/jiajunhuang/natproxy/pb"
+)
+
+// 命令行参数启动的隧道名
+const defaultTunnel = "default"
+
+var controlSocket = flag.String("control", defaultControlSocket(), "-control=<unix socket路径> 客户端控制接口，可以在运行时增删隧道，为空表示不开启")
+
+// Status is the status of a running client
+type Status struct {
+	Version string         `json:"version"`
+	Tunnels []TunnelStatus `json:"tunnels"`
+}
+
+// 客户端守护进程，管理所有隧道，通过unix socket提供控制接口
+type daemon struct {
+	lock    sync.Mutex
+	tunnels map[string]*tunnel
+
+	exitCh   chan struct{} // 客户端需要退出时关闭
+	exitOnce sync.Once
+}
+
+func newDaemon() *daemon {
+	return &daemon{tunnels: make(map[string]*tunnel), exitCh: make(chan struct{})}
+}
+
+func (d *daemon) exit() {
+	d.exitOnce.Do(func() { close(d.exitCh) })
+}
+
+// 添加并启动隧道，同名隧道已经停止的话替换掉
+func (d *daemon) add(t *tunnel) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if old, ok := d.tunnels[t.config.Name]; ok && old.getStatus().State != tunnelStopped {
+		return errors.ErrTunnelExists
+	}
+	d.tunnels[t.config.Name] = t
+	go d.run(t)
+
+	logger.Info("添加隧道", "tunnel_name", t.config.Name, "local", t.config.Local, "type", t.config.Type)
+	return nil
+}
+
+func (d *daemon) remove(name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	t, ok := d.tunnels[name]
+	if !ok {
+		return errors.ErrTunnelNotFound
+	}
+	delete(d.tunnels, name)
+	t.stop()
+
+	logger.Info("删除隧道", "tunnel_name", name)
+	return nil
+}
+
+func (d *daemon) running() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	n := 0
+	for _, t := range d.tunnels {
+		if t.getStatus().State != tunnelStopped {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *daemon) status() *Status {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	status := &Status{Version: version, Tunnels: []TunnelStatus{}}
+	for _, t := range d.tunnels {
+		status.Tunnels = append(status.Tunnels, t.getStatus())
+	}
+	sort.Slice(status.Tunnels, func(i, j int) bool { return status.Tunnels[i].Name < status.Tunnels[j].Name })
+	return status
+}
+
+// 运行隧道，token不对或者客户端太旧时所有隧道都无法工作，直接退出
+func (d *daemon) run(t *tunnel) {
+	err := t.run()
+	if err == nil {
+		return
+	}
+
+	code := pb.ErrorCode_UnknownError
+	if serverErr, ok := err.(*serverError); ok {
+		code = serverErr.Code
+	}
+	switch {
+	case err == errors.ErrTokenNotValid || code == pb.ErrorCode_TokenNotValid:
+		logger.Error("您的token不对，请检查是否正确配置，参考：https://jiajunhuang.com/natproxy")
+		d.exit()
+	case code == pb.ErrorCode_TokenExpired:
+		logger.Error("您的token已过期，请联系管理员")
+		d.exit()
+	case err == errors.ErrClientTooOld || code == pb.ErrorCode_ClientTooOld:
+		logger.Error("客户端版本太旧，请升级，参考：https://jiajunhuang.com/natproxy")
+		d.exit()
+	case d.running() == 0:
+		// 最后一个隧道也停止了，没有必要继续运行
+		d.exit()
+	}
+}
+
+// 控制接口默认放在只有当前用户能访问的目录里
+func defaultControlSocket() string {
+	if dir := sysos.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "natproxy.sock")
+	}
+	dir, err := configDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "natproxy.sock")
+}
+
+// 控制接口的监听器，关闭时删除socket文件
+type controlListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *controlListener) Close() error {
+	err := l.UnixListener.Close()
+	sysos.Remove(l.path)
+	return err
+}
+
+// 监听控制接口。socket先在只有当前用户能访问的临时目录里创建并设置权限，再移动到指定的路径，
+// 其他用户任何时候都连接不上。指定的路径上不是socket文件的话拒绝覆盖
+func listenControl(path string) (net.Listener, error) {
+	if info, err := sysos.Lstat(path); err == nil {
+		if info.Mode()&sysos.ModeSocket == 0 {
+			return nil, errors.ErrNotSocket
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.ErrDaemonRunning
+		}
+	}
+
+	if err := sysos.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".natproxy")
+	if err != nil {
+		return nil, err
+	}
+	defer sysos.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "control.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// socket文件会被移走，关闭时由controlListener删除
+	listener.SetUnlinkOnClose(false)
+	if err := sysos.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// 上次异常退出时留下的socket文件直接被替换掉
+	if err := sysos.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &controlListener{UnixListener: listener, path: path}, nil
+}
+
+// ServeHTTP serves the control API:
+//
+//	GET    /status          status of the client and all tunnels
+//	POST   /tunnels         add a tunnel, body is a TunnelConfig
+//	DELETE /tunnels/<name>  remove a tunnel
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/status" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, d.status())
+	case r.URL.Path == "/tunnels" && r.Method == http.MethodPost:
+		var config TunnelConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		t, err := newTunnel(config)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := d.add(t); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, t.getStatus())
+	case strings.HasPrefix(r.URL.Path, "/tunnels/") && r.Method == http.MethodDelete:
+		if err := d.remove(strings.TrimPrefix(r.URL.Path, "/tunnels/")); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/logger"
+	"github.com/jiajunhuang/natproxy/pb"
+	"github.com/jiajunhuang/natproxy/protocol"
+)
+
+// 心跳：定期给服务器发送ping，太久没有收到服务器的任何消息就断开控制连接，换一个连接重连。
+// 网络中断时TCP连接可能很久都不会报错，没有心跳客户端会一直等着一个已经不存在的会话
+type heartbeat struct {
+	cancel   context.CancelFunc // 断开控制通道
+	interval time.Duration      // 发送ping的间隔
+	last     int64              // 最后一次收到服务器消息的时间，unix纳秒
+	expired  int32
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newHeartbeat(cancel context.CancelFunc) *heartbeat {
+	return &heartbeat{cancel: cancel, interval: *pingInterval, last: time.Now().UnixNano(), stopCh: make(chan struct{})}
+}
+
+// 不发送心跳时不能声明支持，否则服务器会因为收不到心跳断开连接
+func clientFeatures() []string {
+	if *pingInterval > 0 {
+		return protocol.Features
+	}
+
+	var features []string
+	for _, feature := range protocol.Features {
+		if feature != protocol.FeatureHeartbeat {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// 服务器超时之前至少发送3次ping，在run之前调用
+func (h *heartbeat) setServerTimeout(timeout time.Duration) {
+	if limit := timeout / 3; limit > 0 && h.interval > limit {
+		logger.Info("服务器的心跳超时时间较短，缩短发送间隔", "server_timeout", timeout, "interval", limit)
+		h.interval = limit
+	}
+}
+
+func (h *heartbeat) received() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+func (h *heartbeat) timeout() time.Duration {
+	return h.interval * 3
+}
+
+// 控制连接是否因为心跳超时被断开
+func (h *heartbeat) timedOut() bool {
+	return atomic.LoadInt32(&h.expired) == 1
+}
+
+func (h *heartbeat) stop() {
+	h.stopOnce.Do(func() { close(h.stopCh) })
+}
+
+// 双方都支持心跳时才启动
+func (h *heartbeat) run(stream pb.ServerService_MsgClient) {
+	if h.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-h.stopCh:
+			return
+		}
+
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&h.last))) > h.timeout() {
+			atomic.StoreInt32(&h.expired, 1)
+			h.cancel()
+			return
+		}
+
+		ping := &pb.MsgRequest{Payload: &pb.MsgRequest_Ping{Ping: &pb.PingPong{UnixNano: now.UnixNano()}}}
+		if err := send(stream, ping); err != nil {
+			logger.Warn("无法发送心跳", "error", err)
+		}
+	}
+}
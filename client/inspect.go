@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/dial"
+	"github.com/jiajunhuang/natproxy/inspector"
+)
+
+// 逐个解析服务器转发过来的HTTP请求，转发给本地服务，并把请求和响应记录下来
+func inspectHTTP(inspect *inspector.Inspector, conn, localConn net.Conn, options dial.JoinOptions) dial.Stats {
+	server := &dial.CountConn{Conn: conn}
+	serverReader := bufio.NewReader(server)
+	localReader := bufio.NewReader(localConn)
+
+	var stats dial.Stats
+	for {
+		req, err := http.ReadRequest(serverReader)
+		if err != nil {
+			stats.Closer = conn
+			if err != io.EOF {
+				stats.Err = err
+			}
+			break
+		}
+
+		exchange := &inspector.Exchange{Time: time.Now()}
+		capturedReq := inspector.CaptureRequest(req)
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header.Set("User-Agent", "")
+		}
+		err = req.Write(localConn)
+		exchange.Request = capturedReq()
+		if err != nil {
+			exchange.Error = err.Error()
+			inspect.Add(exchange)
+			stats.Closer, stats.Err = localConn, err
+			break
+		}
+
+		resp, err := http.ReadResponse(localReader, req)
+		if err != nil {
+			exchange.Error = err.Error()
+			inspect.Add(exchange)
+			stats.Closer, stats.Err = localConn, err
+			break
+		}
+		capturedResp := inspector.CaptureResponse(resp)
+		err = resp.Write(server)
+		resp.Body.Close()
+		exchange.Response = capturedResp()
+		exchange.DurationMS = int64(time.Since(exchange.Time) / time.Millisecond)
+		inspect.Add(exchange)
+		if err != nil {
+			stats.Closer, stats.Err = conn, err
+			break
+		}
+
+		// 协议升级之后无法再解析，直接转发
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			c1 := &dial.BufferedConn{Conn: server, Reader: serverReader}
+			c2 := &dial.BufferedConn{Conn: localConn, Reader: localReader}
+			joined := dial.JoinWith(c1, c2, options)
+			stats.Closer, stats.Err = conn, joined.Err
+			if joined.Closer == c2 {
+				stats.Closer = localConn
+			}
+			break
+		}
+
+		if resp.Close {
+			stats.Closer = localConn
+			break
+		}
+		if req.Close {
+			stats.Closer = conn
+			break
+		}
+	}
+
+	stats.InCount, stats.OutCount = server.WriteCount, server.ReadCount
+	return stats
+}
@@ -0,0 +1,20 @@
+package client
+
+import (
+	"github.com/jiajunhuang/natproxy/pb"
+)
+
+// 服务器返回的错误
+type serverError struct {
+	Code      pb.ErrorCode
+	Message   string
+	Retryable bool
+}
+
+func newServerError(info *pb.ErrorInfo) *serverError {
+	return &serverError{Code: info.Code, Message: info.Message, Retryable: info.Retryable}
+}
+
+func (e *serverError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/dial"
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+// 连接失败的服务器在这段时间内不优先选择
+const serverFailBackoff = time.Second * 30
+
+type serverEndpoint struct {
+	addr     string
+	priority int // 越小越优先
+	failedAt time.Time
+}
+
+// 按优先级排好序的服务器列表，-server=a:8443@0,b:8443@1 不写优先级时按顺序
+type serverList struct {
+	servers []*serverEndpoint
+}
+
+func parseServerList(list string) (*serverList, error) {
+	l := &serverList{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		server := &serverEndpoint{addr: entry, priority: len(l.servers)}
+		if i := strings.LastIndex(entry, "@"); i >= 0 {
+			priority, err := strconv.Atoi(entry[i+1:])
+			if err != nil {
+				return nil, errors.ErrBadServerAddr
+			}
+			server.addr, server.priority = entry[:i], priority
+		}
+		l.servers = append(l.servers, server)
+	}
+	if len(l.servers) == 0 {
+		return nil, errors.ErrBadServerAddr
+	}
+
+	sort.SliceStable(l.servers, func(i, j int) bool { return l.servers[i].priority < l.servers[j].priority })
+	return l, nil
+}
+
+func (s *serverEndpoint) healthy(now time.Time) bool {
+	return s.failedAt.IsZero() || now.Sub(s.failedAt) > serverFailBackoff
+}
+
+// 选择优先级最高的可用服务器，都不可用时选最早失败的那个
+func (l *serverList) next(now time.Time) *serverEndpoint {
+	best := l.servers[0]
+	for _, server := range l.servers {
+		if server.healthy(now) {
+			return server
+		}
+		if server.failedAt.Before(best.failedAt) {
+			best = server
+		}
+	}
+	return best
+}
+
+func (l *serverList) markFailed(server *serverEndpoint, now time.Time) {
+	server.failedAt = now
+}
+
+// 服务器恢复之后可以马上选择
+func (l *serverList) markRecovered(server *serverEndpoint) {
+	server.failedAt = time.Time{}
+}
+
+// 优先级比server高的服务器，按优先级排序
+func (l *serverList) better(server *serverEndpoint) []*serverEndpoint {
+	var servers []*serverEndpoint
+	for _, s := range l.servers {
+		if s.priority >= server.priority {
+			break
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// 连上端口并完成TLS握手就认为服务器恢复了
+func probeServer(socket *dial.SocketOptions, addr string) bool {
+	var conn net.Conn
+	var err error
+	if *useTLS {
+		conn, err = socket.DialTLS("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	} else {
+		conn, err = socket.Dial("tcp", addr)
+	}
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
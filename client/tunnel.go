@@ -0,0 +1,288 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/compression"
+	"github.com/jiajunhuang/natproxy/dial"
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/inspector"
+	"github.com/jiajunhuang/natproxy/ipfilter"
+	"github.com/jiajunhuang/natproxy/logger"
+	"github.com/jiajunhuang/natproxy/proxyproto"
+)
+
+// 隧道状态
+const (
+	tunnelConnecting = "connecting"
+	tunnelOnline     = "online"
+	tunnelRetrying   = "retrying"
+	tunnelStopped    = "stopped"
+)
+
+// TunnelConfig is the config of a tunnel, tunnels added at runtime use the same fields as flags
+type TunnelConfig struct {
+	Name          string `json:"name"`
+	Local         string `json:"local"`
+	Type          string `json:"type"`
+	HTTPHost      string `json:"http_host,omitempty"`
+	HTTPAuth      string `json:"http_auth,omitempty"`
+	HTTPBearer    string `json:"http_bearer,omitempty"`
+	Allow         string `json:"allow,omitempty"`
+	Deny          string `json:"deny,omitempty"`
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+	Compress      string `json:"compress,omitempty"`
+	Group         string `json:"group,omitempty"`
+	LB            string `json:"lb,omitempty"`
+
+	Socket dial.SocketOptions `json:"socket"` // 到服务器的数据连接
+	Join   dial.JoinOptions   `json:"join"`   // 转发的连接
+}
+
+// TunnelStatus is the status of a running tunnel
+type TunnelStatus struct {
+	TunnelConfig
+	State  string    `json:"state"`
+	Server string    `json:"server,omitempty"`
+	Tunnel string    `json:"tunnel,omitempty"` // 公网地址
+	Error  string    `json:"error,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// 从命令行参数读取隧道配置
+func configFromFlags(name string) TunnelConfig {
+	return TunnelConfig{
+		Name:          name,
+		Local:         *localAddr,
+		Type:          *tunnelType,
+		HTTPHost:      *httpHost,
+		HTTPAuth:      *httpAuth,
+		HTTPBearer:    *httpBearer,
+		Allow:         *allowCIDR,
+		Deny:          *denyCIDR,
+		ProxyProtocol: *proxyProtocol,
+		Compress:      *compress,
+		Group:         *group,
+		LB:            *lbPolicy,
+		Socket: dial.SocketOptions{
+			DialTimeout: *dialTimeout,
+			IdleTimeout: *idleTimeout,
+			KeepAlive:   *keepAlive,
+			Delay:       !*noDelay,
+			ReadBuffer:  *readBuffer,
+			WriteBuffer: *writeBuffer,
+		},
+		Join: dial.JoinOptions{
+			IdleTimeout:      *connIdleTimeout,
+			MaxLifetime:      *connMaxLifetime,
+			HalfCloseTimeout: *connHalfClose,
+		},
+	}
+}
+
+func (c *TunnelConfig) validate() error {
+	if c.Name == "" {
+		return errors.ErrBadTunnelName
+	}
+	if c.Type != "tcp" && c.Type != "http" {
+		return errors.ErrNotSupport
+	}
+	if _, err := ipfilter.New(c.Allow, c.Deny); err != nil {
+		return err
+	}
+	if c.ProxyProtocol != "" && c.ProxyProtocol != proxyproto.V1 && c.ProxyProtocol != proxyproto.V2 {
+		return errors.ErrNotSupport
+	}
+	if !compression.Supported(c.Compress) {
+		return errors.ErrNotSupport
+	}
+	return nil
+}
+
+// 一个隧道对应一个到服务器的控制连接和一组本地后端
+type tunnel struct {
+	config   TunnelConfig
+	servers  *serverList
+	backends *backendPool
+	inspect  *inspector.Inspector // 只有命令行启动的http隧道可以开启请求检查
+
+	stopCh   chan struct{} // 隧道被删除时关闭
+	stopOnce sync.Once
+
+	lock   sync.Mutex
+	status TunnelStatus
+}
+
+func newTunnel(config TunnelConfig) (*tunnel, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	servers, err := parseServerList(*serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := newBackendPool(config.Local, config.LB)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tunnel{
+		config:   config,
+		servers:  servers,
+		backends: backends,
+		stopCh:   make(chan struct{}),
+	}
+	t.status = TunnelStatus{TunnelConfig: config, State: tunnelConnecting, Since: time.Now()}
+	return t, nil
+}
+
+func (t *tunnel) stop() {
+	t.stopOnce.Do(func() { close(t.stopCh) })
+}
+
+func (t *tunnel) stopped() bool {
+	select {
+	case <-t.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *tunnel) setStatus(state, server, wanAddr string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.status.State, t.status.Server, t.status.Tunnel, t.status.Since = state, server, wanAddr, time.Now()
+	t.status.Error = ""
+	if err != nil {
+		t.status.Error = err.Error()
+	}
+}
+
+func (t *tunnel) getStatus() TunnelStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.status
+}
+
+// 保持隧道在线直到被删除或者服务器拒绝服务，返回不可重试的错误
+func (t *tunnel) run() error {
+	if len(t.backends.backends) > 1 && *healthInterval > 0 {
+		t.backends.startHealthCheck(*healthInterval, *healthTimeout, t.stopCh)
+	}
+
+	backoff := minRetryInterval
+	reconnected := false // 收到Reconnect之后已经马上重连过一次
+	for !t.stopped() {
+		server := t.servers.next(time.Now())
+		start := time.Now()
+		t.setStatus(tunnelConnecting, server.addr, "", nil)
+
+		// 连在备用服务器上时探测优先级更高的服务器，恢复了就断开重连
+		var recovered *serverEndpoint
+		failback, probeStop := make(chan struct{}), make(chan struct{})
+		go func() {
+			if recovered = t.probeBetter(server, probeStop); recovered != nil {
+				close(failback)
+			}
+		}()
+		err := t.waitMsgFromServer(server.addr, failback)
+		close(probeStop)
+		if t.stopped() {
+			break
+		}
+		select {
+		case <-failback:
+			logger.Info("优先级更高的服务器已恢复，切换过去", "tunnel_name", t.config.Name, "server", recovered.addr)
+			t.servers.markRecovered(recovered)
+			backoff = minRetryInterval
+			continue
+		default:
+		}
+
+		// 连接持续了一段时间说明之前是正常的，重新开始退避
+		if time.Since(start) > maxRetryInterval {
+			backoff = minRetryInterval
+			reconnected = false
+		}
+		if err == errors.ErrServerShuttingDown && !reconnected {
+			// 服务器在热升级或者重启，马上重连一次，新的进程会接管原来的公网端口。服务器正在退出时
+			// 会一直拒绝连接，再失败就和其他错误一样退避并换一个服务器
+			reconnected = true
+			continue
+		}
+		if serverErr, ok := err.(*serverError); ok {
+			if !serverErr.Retryable {
+				logger.Error("服务器拒绝服务，不再重试", "tunnel_name", t.config.Name, "code", serverErr.Code, "error", serverErr.Message)
+				t.setStatus(tunnelStopped, server.addr, "", err)
+				return err
+			}
+		}
+		if fatal := legacyFatalError(err); fatal != nil {
+			t.setStatus(tunnelStopped, server.addr, "", fatal)
+			return fatal
+		}
+
+		// 换下一个服务器，都不可用时等一会再重试，连续失败时等待时间翻倍
+		now := time.Now()
+		t.servers.markFailed(server, now)
+		t.setStatus(tunnelRetrying, server.addr, "", err)
+		if next := t.servers.next(now); !next.healthy(now) {
+			logger.Info("等待重试", "tunnel_name", t.config.Name, "after", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-t.stopCh:
+			}
+			if backoff *= 2; backoff > maxRetryInterval {
+				backoff = maxRetryInterval
+			}
+		} else {
+			logger.Warn("切换到下一个服务器", "tunnel_name", t.config.Name, "server", next.addr)
+		}
+	}
+
+	t.setStatus(tunnelStopped, "", "", nil)
+	return nil
+}
+
+// 每隔failbackInterval探测一次优先级比current高的服务器，返回第一个恢复的，stop关闭时返回nil
+func (t *tunnel) probeBetter(current *serverEndpoint, stop <-chan struct{}) *serverEndpoint {
+	better := t.servers.better(current)
+	if len(better) == 0 || *failbackInterval <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(*failbackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		case <-t.stopCh:
+			return nil
+		}
+
+		for _, server := range better {
+			if probeServer(&t.config.Socket, server.addr) {
+				return server
+			}
+		}
+	}
+}
+
+// 旧版本服务器不会发送错误消息，只能看错误信息
+func legacyFatalError(err error) error {
+	errMsg := err.Error()
+	if strings.Contains(errMsg, errors.ErrTokenNotValid.Error()) {
+		return errors.ErrTokenNotValid
+	}
+	if err == errors.ErrClientTooOld || strings.Contains(errMsg, errors.ErrClientTooOld.Error()) {
+		return errors.ErrClientTooOld
+	}
+	return nil
+}
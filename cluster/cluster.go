@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"flag"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+// backends of session store
+const (
+	BackendMemory = "memory"
+	BackendFile   = "file"
+	BackendRaft   = "raft"
+)
+
+var (
+	backend  = flag.String("clusterBackend", BackendMemory, "where sessions are shared between servers: memory(single server), file or raft")
+	filePath = flag.String("clusterFile", "/var/lib/natproxy/cluster.json", "state file of file backend, it must be shared by all servers in the cluster")
+	nodeID   = flag.String("nodeID", "", "unique id of this server in the cluster, default to hostname")
+	nodeTTL  = flag.Duration("nodeTTL", time.Second*30, "sessions of a server are expired if it doesn't heartbeat in this duration")
+)
+
+// Session is a live tunnel session owned by a server
+type Session struct {
+	ID     string    `json:"id"`
+	Node   string    `json:"node"`
+	Token  string    `json:"token"` // hash of token
+	Group  string    `json:"group,omitempty"`
+	Client string    `json:"client"`
+	Tunnel string    `json:"tunnel,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Store shares sessions between servers
+type Store interface {
+	// Node returns id of this server
+	Node() string
+	// Claim adds or updates a session of this server, it fails with errors.ErrSessionTaken if
+	// the token is online on another server
+	Claim(session *Session) error
+	// Release removes a session of this server
+	Release(id string) error
+	// List returns sessions of all alive servers
+	List() ([]Session, error)
+	// Heartbeat tells other servers this one is alive, it should be called periodically
+	Heartbeat() error
+	// Handoff is called after a new process of this server is started in hot upgrade, stores
+	// which can't be opened by both processes release their resources here and do nothing after it
+	Handoff() error
+	// Close the store, sessions should be released by their owners before it
+	Close() error
+}
+
+// Open returns a Store configured by command line flags
+func Open() (Store, error) {
+	node := *nodeID
+	if node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		node = hostname
+	}
+
+	switch *backend {
+	case BackendMemory:
+		return NewMemoryStore(node), nil
+	case BackendFile:
+		return NewFileStore(*filePath, node, *nodeTTL), nil
+	case BackendRaft:
+		peers, err := parsePeers(*raftPeers, node, *raftAddr)
+		if err != nil {
+			return nil, err
+		}
+		return NewRaftStore(node, *raftAddr, *raftDir, peers, *nodeTTL)
+	default:
+		return nil, errors.ErrNotSupport
+	}
+}
+
+// HeartbeatInterval returns how often Heartbeat should be called
+func HeartbeatInterval() time.Duration {
+	return *nodeTTL / 3
+}
+
+// state is shared by all backends, backends only differ in where it's kept
+type state struct {
+	Nodes    map[string]time.Time `json:"nodes"` // last heartbeat of each server
+	Sessions map[string]*Session  `json:"sessions"`
+}
+
+func newState() *state {
+	return &state{Nodes: make(map[string]time.Time), Sessions: make(map[string]*Session)}
+}
+
+// remove servers which stopped heartbeat, and their sessions
+func (s *state) expire(now time.Time, ttl time.Duration) {
+	for node, seen := range s.Nodes {
+		if now.Sub(seen) > ttl {
+			delete(s.Nodes, node)
+		}
+	}
+	for id, session := range s.Sessions {
+		if _, ok := s.Nodes[session.Node]; !ok {
+			delete(s.Sessions, id)
+		}
+	}
+}
+
+func (s *state) claim(session *Session) error {
+	for _, other := range s.Sessions {
+		if other.Token == session.Token && other.Node != session.Node {
+			return errors.ErrSessionTaken
+		}
+	}
+
+	s.Sessions[session.ID] = session
+	return nil
+}
+
+func (s *state) release(node, id string) {
+	if session, ok := s.Sessions[id]; ok && session.Node == node {
+		delete(s.Sessions, id)
+	}
+}
+
+func (s *state) list() []Session {
+	sessions := make([]Session, 0, len(s.Sessions))
+	for _, session := range s.Sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Since.Before(sessions[j].Since) })
+
+	return sessions
+}
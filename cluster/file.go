@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+const (
+	lockRetryInterval = time.Millisecond * 10
+	lockTimeout       = time.Second * 5
+	lockStale         = time.Second * 10 // lock file older than this is left by a crashed server
+)
+
+// FileStore keeps sessions in a json file shared by all servers, such as a file on NFS. It's
+// simple and slow, use it for small clusters and tests
+type FileStore struct {
+	path string
+	node string
+	ttl  time.Duration
+}
+
+// NewFileStore returns a FileStore
+func NewFileStore(path, node string, ttl time.Duration) *FileStore {
+	return &FileStore{path: path, node: node, ttl: ttl}
+}
+
+// Node returns id of this server
+func (s *FileStore) Node() string {
+	return s.node
+}
+
+// 用O_EXCL创建锁文件作为跨进程的锁
+func (s *FileStore) lock() error {
+	lockPath := s.path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if err == nil {
+			f.Close()
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > lockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return errors.ErrLockTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+func (s *FileStore) unlock() {
+	os.Remove(s.path + ".lock")
+}
+
+// update loads the state, applies fn and saves it back if fn succeeded
+func (s *FileStore) update(fn func(st *state) error) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.unlock()
+
+	st := newState()
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, st); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	st.expire(now, s.ttl)
+	st.Nodes[s.node] = now
+	if err := fn(st); err != nil {
+		return err
+	}
+
+	if data, err = json.Marshal(st); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Claim adds or updates a session
+func (s *FileStore) Claim(session *Session) error {
+	session.Node = s.node
+	claimed := *session
+	return s.update(func(st *state) error { return st.claim(&claimed) })
+}
+
+// Release removes a session
+func (s *FileStore) Release(id string) error {
+	return s.update(func(st *state) error {
+		st.release(s.node, id)
+		return nil
+	})
+}
+
+// List returns sessions of all alive servers
+func (s *FileStore) List() ([]Session, error) {
+	var sessions []Session
+	err := s.update(func(st *state) error {
+		sessions = st.list()
+		return nil
+	})
+	return sessions, err
+}
+
+// Heartbeat refreshes the last seen time of this server
+func (s *FileStore) Heartbeat() error {
+	return s.update(func(*state) error { return nil })
+}
+
+// Close does nothing, sessions of a crashed server are expired by other servers
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// Handoff does nothing, both processes can share the file
+func (s *FileStore) Handoff() error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps sessions in memory, it's for a single server
+type MemoryStore struct {
+	lock  sync.Mutex
+	node  string
+	state *state
+}
+
+// NewMemoryStore returns a MemoryStore
+func NewMemoryStore(node string) *MemoryStore {
+	s := &MemoryStore{node: node, state: newState()}
+	s.state.Nodes[node] = time.Now()
+	return s
+}
+
+// Node returns id of this server
+func (s *MemoryStore) Node() string {
+	return s.node
+}
+
+// Claim adds or updates a session
+func (s *MemoryStore) Claim(session *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session.Node = s.node
+	claimed := *session
+	return s.state.claim(&claimed)
+}
+
+// Release removes a session
+func (s *MemoryStore) Release(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state.release(s.node, id)
+	return nil
+}
+
+// List returns all sessions
+func (s *MemoryStore) List() ([]Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.state.list(), nil
+}
+
+// Heartbeat does nothing, there is no other server
+func (s *MemoryStore) Heartbeat() error {
+	return nil
+}
+
+// Close does nothing
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Handoff does nothing, the new process starts with its own memory
+func (s *MemoryStore) Handoff() error {
+	return nil
+}
@@ -0,0 +1,501 @@
+package cluster
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+var (
+	raftAddr  = flag.String("raftAddr", "", "raft backend: address of this server for raft and forwarded writes, it must be reachable by other servers and not by the public, raft traffic isn't encrypted or authenticated")
+	raftDir   = flag.String("raftDir", "/var/lib/natproxy/raft", "raft backend: directory of raft log and snapshots")
+	raftPeers = flag.String("raftPeers", "", "raft backend: comma separated id=addr of all servers, used only to bootstrap a new cluster, empty means a cluster of this server only")
+)
+
+const (
+	raftApplyTimeout  = time.Second * 5
+	raftHeaderTimeout = time.Second * 10
+	raftRetryInterval = time.Millisecond * 100
+	raftListenTimeout = time.Second * 10
+	raftMaxPool       = 3
+	raftSnapshots     = 2
+
+	// 连接的第一个字节区分raft的RPC和转发给leader的写请求，两者共用一个端口
+	raftConnRPC     byte = 0
+	raftConnForward byte = 1
+
+	raftOpClaim     = "claim"
+	raftOpRelease   = "release"
+	raftOpHeartbeat = "heartbeat"
+)
+
+// RaftStore keeps sessions in an embedded raft cluster. Writes are applied on the leader, followers
+// forward their writes to it. Reads are answered from the local copy, which may be a little behind
+type RaftStore struct {
+	node        string
+	incarnation int64 // start time of this process, sessions claimed by a previous process are dropped
+	ttl         time.Duration
+	raft        *raft.Raft
+	fsm         *raftFSM
+	layer       *raftLayer
+	logs        *boltStore
+	handedOff   int32 // the new process has taken over in hot upgrade
+}
+
+// 写操作，带上发起者的时间，所有服务器按同样的时间过期节点，结果才一致
+type raftCommand struct {
+	Op          string        `json:"op"`
+	Node        string        `json:"node"`
+	Incarnation int64         `json:"incarnation"`
+	Time        time.Time     `json:"time"`
+	TTL         time.Duration `json:"ttl"`
+	Session     *Session      `json:"session,omitempty"`
+	ID          string        `json:"id,omitempty"`
+}
+
+type raftResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// -raftPeers=a=10.0.0.1:7000,b=10.0.0.2:7000 必须包含这台服务器，为空表示只有这台服务器
+func parsePeers(list, node, addr string) ([]raft.Server, error) {
+	if list == "" {
+		return []raft.Server{{ID: raft.ServerID(node), Address: raft.ServerAddress(addr)}}, nil
+	}
+
+	var peers []raft.Server
+	self := false
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.ErrBadRaftPeers
+		}
+		peers = append(peers, raft.Server{ID: raft.ServerID(parts[0]), Address: raft.ServerAddress(parts[1])})
+		self = self || parts[0] == node
+	}
+	if !self {
+		return nil, errors.ErrBadRaftPeers
+	}
+	return peers, nil
+}
+
+// NewRaftStore starts a raft node listening on addr, a new cluster is bootstrapped with peers if dir
+// has no raft state
+func NewRaftStore(node, addr, dir string, peers []raft.Server, ttl time.Duration) (*RaftStore, error) {
+	if addr == "" {
+		return nil, errors.ErrBadRaftPeers
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	listener, err := listenRetry(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &RaftStore{node: node, incarnation: time.Now().UnixNano(), ttl: ttl, fsm: newRaftFSM()}
+	s.layer = newRaftLayer(listener, s.serveForward)
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(node)
+	config.LogOutput = os.Stderr
+	config.LogLevel = "WARN"
+
+	s.logs, err = openBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		s.layer.Close()
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, raftSnapshots, os.Stderr)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	transport := raft.NewNetworkTransport(s.layer, raftMaxPool, raftApplyTimeout, os.Stderr)
+
+	exists, err := raft.HasExistingState(s.logs, s.logs, snapshots)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.raft, err = raft.NewRaft(config, s.fsm, s.logs, s.logs, snapshots, transport)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	// 所有服务器用同样的peers启动，只有第一次启动时需要
+	if !exists {
+		if err := s.raft.BootstrapCluster(raft.Configuration{Servers: peers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	go s.layer.serve()
+	return s, nil
+}
+
+// 热升级时旧进程启动新进程之后才交出raft端口，等一会再试
+func listenRetry(addr string) (net.Listener, error) {
+	deadline := time.Now().Add(raftListenTimeout)
+	for {
+		listener, err := net.Listen("tcp", addr)
+		if err == nil || time.Now().After(deadline) {
+			return listener, err
+		}
+		time.Sleep(raftRetryInterval)
+	}
+}
+
+// Node returns id of this server
+func (s *RaftStore) Node() string {
+	return s.node
+}
+
+// Claim adds or updates a session
+func (s *RaftStore) Claim(session *Session) error {
+	session.Node = s.node
+	claimed := *session
+	return s.apply(&raftCommand{Op: raftOpClaim, Session: &claimed})
+}
+
+// Release removes a session
+func (s *RaftStore) Release(id string) error {
+	return s.apply(&raftCommand{Op: raftOpRelease, ID: id})
+}
+
+// List returns sessions of all alive servers from the local copy
+func (s *RaftStore) List() ([]Session, error) {
+	return s.fsm.list(time.Now(), s.ttl), nil
+}
+
+// Heartbeat refreshes the last seen time of this server
+func (s *RaftStore) Heartbeat() error {
+	return s.apply(&raftCommand{Op: raftOpHeartbeat})
+}
+
+// Handoff shuts down the raft node, so the new process can open the same address and log. Sessions
+// of this process are dropped when the new process writes for the first time
+func (s *RaftStore) Handoff() error {
+	if !atomic.CompareAndSwapInt32(&s.handedOff, 0, 1) {
+		return nil
+	}
+	return s.shutdown()
+}
+
+// Close shuts down the raft node, sessions of this server are expired by other servers
+func (s *RaftStore) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.handedOff, 0, 1) {
+		return nil
+	}
+	return s.shutdown()
+}
+
+func (s *RaftStore) shutdown() error {
+	err := s.raft.Shutdown().Error()
+	s.close()
+	return err
+}
+
+func (s *RaftStore) close() {
+	s.layer.Close()
+	s.logs.Close()
+}
+
+func (s *RaftStore) apply(cmd *raftCommand) error {
+	if atomic.LoadInt32(&s.handedOff) == 1 {
+		return nil
+	}
+
+	cmd.Node, cmd.Incarnation, cmd.Time, cmd.TTL = s.node, s.incarnation, time.Now(), s.ttl
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	// 刚启动或者正在选举时没有leader，等一会再试
+	deadline := time.Now().Add(raftApplyTimeout)
+	for {
+		if s.raft.State() == raft.Leader {
+			err = s.applyLocal(data)
+		} else {
+			err = s.forward(data)
+		}
+		if err != errors.ErrNoLeader || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(raftRetryInterval)
+	}
+}
+
+func (s *RaftStore) applyLocal(data []byte) error {
+	future := s.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return errors.ErrNoLeader
+		}
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// 把写请求交给leader
+func (s *RaftStore) forward(data []byte) error {
+	leader := s.raft.Leader()
+	if leader == "" {
+		return errors.ErrNoLeader
+	}
+
+	conn, err := s.layer.dial(leader, raftConnForward, raftApplyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(raftApplyTimeout * 2))
+	if err := json.NewEncoder(conn).Encode(json.RawMessage(data)); err != nil {
+		return err
+	}
+	var resp raftResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+
+	switch resp.Error {
+	case "":
+		return nil
+	case errors.ErrSessionTaken.Error():
+		return errors.ErrSessionTaken
+	case errors.ErrNoLeader.Error():
+		return errors.ErrNoLeader
+	}
+	return fmt.Errorf("leader %s: %s", leader, resp.Error)
+}
+
+// 处理follower转发过来的写请求，leader刚刚换掉时让follower重试
+func (s *RaftStore) serveForward(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(raftApplyTimeout * 2))
+	var data json.RawMessage
+	if err := json.NewDecoder(conn).Decode(&data); err != nil {
+		return
+	}
+
+	var resp raftResponse
+	err := errors.ErrNoLeader
+	if s.raft.State() == raft.Leader {
+		err = s.applyLocal(data)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(&resp)
+}
+
+// raftFSM applies commands to the shared state
+type raftFSM struct {
+	lock         sync.Mutex
+	state        *state
+	incarnations map[string]int64 // the process which wrote last on each server
+}
+
+func newRaftFSM() *raftFSM {
+	return &raftFSM{state: newState(), incarnations: make(map[string]int64)}
+}
+
+// raftFSM的快照
+type raftFSMState struct {
+	State        *state           `json:"state"`
+	Incarnations map[string]int64 `json:"incarnations"`
+}
+
+// Apply runs a command, the returned error is the result of Claim
+func (f *raftFSM) Apply(log *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.state.expire(cmd.Time, cmd.TTL)
+	f.state.Nodes[cmd.Node] = cmd.Time
+	// 服务器重启或者热升级之后，之前的进程留下的会话已经不存在了
+	if f.incarnations[cmd.Node] != cmd.Incarnation {
+		for id, session := range f.state.Sessions {
+			if session.Node == cmd.Node {
+				delete(f.state.Sessions, id)
+			}
+		}
+		f.incarnations[cmd.Node] = cmd.Incarnation
+	}
+	switch cmd.Op {
+	case raftOpClaim:
+		if cmd.Session == nil {
+			return errors.ErrBadRequest
+		}
+		return f.state.claim(cmd.Session)
+	case raftOpRelease:
+		f.state.release(cmd.Node, cmd.ID)
+	}
+	return nil
+}
+
+// Snapshot copies the state
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, err := json.Marshal(&raftFSMState{State: f.state, Incarnations: f.incarnations})
+	if err != nil {
+		return nil, err
+	}
+	return raftSnapshot(data), nil
+}
+
+// Restore replaces the state with a snapshot
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	st := &raftFSMState{State: newState(), Incarnations: make(map[string]int64)}
+	if err := json.NewDecoder(rc).Decode(st); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.state, f.incarnations = st.State, st.Incarnations
+	return nil
+}
+
+// 过期的节点要等下一次写操作才会删除，读的时候先过滤掉
+func (f *raftFSM) list(now time.Time, ttl time.Duration) []Session {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	sessions := f.state.list()
+	alive := sessions[:0]
+	for _, session := range sessions {
+		if seen, ok := f.state.Nodes[session.Node]; ok && now.Sub(seen) <= ttl {
+			alive = append(alive, session)
+		}
+	}
+	return alive
+}
+
+type raftSnapshot []byte
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+// raftLayer is the raft.StreamLayer, it shares the listener with forwarded writes
+type raftLayer struct {
+	listener  net.Listener
+	forward   func(net.Conn)
+	conns     chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newRaftLayer(listener net.Listener, forward func(net.Conn)) *raftLayer {
+	return &raftLayer{
+		listener: listener,
+		forward:  forward,
+		conns:    make(chan net.Conn),
+		closeCh:  make(chan struct{}),
+	}
+}
+
+func (l *raftLayer) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.dispatch(conn)
+	}
+}
+
+func (l *raftLayer) dispatch(conn net.Conn) {
+	header := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(raftHeaderTimeout))
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch header[0] {
+	case raftConnRPC:
+		select {
+		case l.conns <- conn:
+		case <-l.closeCh:
+			conn.Close()
+		}
+	case raftConnForward:
+		l.forward(conn)
+	default:
+		conn.Close()
+	}
+}
+
+// Accept returns raft connections
+func (l *raftLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, errors.ErrServerShuttingDown
+	}
+}
+
+// Close stops accepting connections
+func (l *raftLayer) Close() error {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+	return l.listener.Close()
+}
+
+// Addr returns the address of this server, other servers must be able to reach it
+func (l *raftLayer) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Dial connects to another server for raft RPC
+func (l *raftLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return l.dial(address, raftConnRPC, timeout)
+}
+
+func (l *raftLayer) dial(address raft.ServerAddress, kind byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,244 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// 启动三个节点的集群，返回的函数关闭集群
+func startRaftCluster(t *testing.T) ([]*RaftStore, func()) {
+	dir, err := ioutil.TempDir("", "natproxy-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var peers []raft.Server
+	for i := 0; i < 3; i++ {
+		peers = append(peers, raft.Server{ID: raft.ServerID(fmt.Sprintf("n%d", i)), Address: raft.ServerAddress(freeAddr(t))})
+	}
+
+	var stores []*RaftStore
+	stop := func() {
+		for _, s := range stores {
+			s.Close()
+		}
+		os.RemoveAll(dir)
+	}
+	for _, peer := range peers {
+		s, err := NewRaftStore(string(peer.ID), string(peer.Address), filepath.Join(dir, string(peer.ID)), peers, time.Minute)
+		if err != nil {
+			stop()
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+	return stores, stop
+}
+
+// 等到选出leader并且写操作能成功
+func waitLeader(t *testing.T, s *RaftStore) {
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		err := s.Heartbeat()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no leader: %v", err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// 等到本地副本满足条件
+func waitSessions(t *testing.T, s *RaftStore, want int) []Session {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		sessions, _ := s.List()
+		if len(sessions) == want {
+			return sessions
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got %d sessions, want %d", s.Node(), len(sessions), want)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestRaftStore(t *testing.T) {
+	stores, stop := startRaftCluster(t)
+	defer stop()
+	for _, s := range stores {
+		waitLeader(t, s)
+	}
+
+	// 每个节点都能写，follower的写请求转发给leader
+	for i, s := range stores {
+		session := &Session{ID: fmt.Sprintf("s%d", i), Token: fmt.Sprintf("t%d", i), Since: time.Now()}
+		if err := s.Claim(session); err != nil {
+			t.Fatalf("%s: claim: %v", s.Node(), err)
+		}
+	}
+	for _, s := range stores {
+		waitSessions(t, s, 3)
+	}
+
+	// 同一个token不能在另一台服务器上线，同一台服务器可以更新
+	if err := stores[1].Claim(&Session{ID: "other", Token: "t0"}); err != errors.ErrSessionTaken {
+		t.Errorf("claim token of another node: got %v, want %v", err, errors.ErrSessionTaken)
+	}
+	if err := stores[0].Claim(&Session{ID: "s0", Token: "t0", Tunnel: "1.2.3.4:5"}); err != nil {
+		t.Errorf("update own session: %v", err)
+	}
+
+	// 只能删除自己的会话，leader上的写操作返回时已经应用到本地副本
+	if err := stores[2].Release("s0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		if s.raft.State() == raft.Leader {
+			if err := s.Heartbeat(); err != nil {
+				t.Fatal(err)
+			}
+			waitSessions(t, s, 3)
+		}
+	}
+	if err := stores[0].Release("s0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		sessions := waitSessions(t, s, 2)
+		for _, session := range sessions {
+			if session.ID == "s0" {
+				t.Errorf("%s: released session is still listed", s.Node())
+			}
+		}
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	tests := []struct {
+		list string
+		ok   bool
+		n    int
+	}{
+		{"", true, 1},
+		{"a=1.1.1.1:7000,b=2.2.2.2:7000", true, 2},
+		{"b=2.2.2.2:7000", false, 0},
+		{"a=1.1.1.1:7000,b", false, 0},
+		{"a=", false, 0},
+	}
+
+	for _, tt := range tests {
+		peers, err := parsePeers(tt.list, "a", "1.1.1.1:7000")
+		if (err == nil) != tt.ok || len(peers) != tt.n {
+			t.Errorf("parsePeers(%q) = %v, %v", tt.list, peers, err)
+		}
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natproxy-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if first, _ := s.FirstIndex(); first != 0 {
+		t.Errorf("first index of empty store = %d", first)
+	}
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: []byte{byte(i)}})
+	}
+	if err := s.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRange(1, 4); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.FirstIndex()
+	last, _ := s.LastIndex()
+	if first != 5 || last != 10 {
+		t.Errorf("got index range %d-%d, want 5-10", first, last)
+	}
+	var log raft.Log
+	if err := s.GetLog(3, &log); err != raft.ErrLogNotFound {
+		t.Errorf("get deleted log: %v", err)
+	}
+	if err := s.GetLog(7, &log); err != nil || log.Data[0] != 7 {
+		t.Errorf("get log 7: %v %v", log, err)
+	}
+
+	if _, err := s.GetUint64([]byte("term")); err != errors.ErrKeyNotFound {
+		t.Errorf("get missing key: %v", err)
+	}
+	s.SetUint64([]byte("term"), 42)
+	if term, err := s.GetUint64([]byte("term")); err != nil || term != 42 {
+		t.Errorf("got term %d %v", term, err)
+	}
+}
+
+// 热升级之后新进程第一次写入时，旧进程的会话被删除
+func TestRaftStoreHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natproxy-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := freeAddr(t)
+	peers, _ := parsePeers("", "n0", addr)
+	old, err := NewRaftStore("n0", addr, dir, peers, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLeader(t, old)
+	if err := old.Claim(&Session{ID: "old", Token: "t0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Handoff(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Release("old"); err != nil {
+		t.Errorf("write after handoff: %v", err)
+	}
+
+	s, err := NewRaftStore("n0", addr, dir, peers, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// 选出leader之后重放日志，旧的会话还在，直到新进程写入
+	for deadline := time.Now().Add(time.Second * 10); s.raft.Leader() == ""; time.Sleep(time.Millisecond * 50) {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader")
+		}
+	}
+	waitSessions(t, s, 1)
+	waitLeader(t, s)
+	waitSessions(t, s, 0)
+}
@@ -0,0 +1,166 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jiajunhuang/natproxy/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 另一个进程还在使用数据库时不要一直等
+const boltOpenTimeout = time.Second * 10
+
+var (
+	bucketLogs   = []byte("logs")
+	bucketStable = []byte("stable")
+)
+
+// boltStore keeps raft log and votes in a bolt database, it's raft.LogStore and raft.StableStore
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketLogs); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketStable)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// 大端序的编号，bolt按字节序排列时就是按编号排列
+func indexKey(index uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, index)
+	return key
+}
+
+// FirstIndex returns the first index written, 0 for no entries
+func (s *boltStore) FirstIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(bucketLogs).Cursor().First(); key != nil {
+			index = binary.BigEndian.Uint64(key)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// LastIndex returns the last index written, 0 for no entries
+func (s *boltStore) LastIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(bucketLogs).Cursor().Last(); key != nil {
+			index = binary.BigEndian.Uint64(key)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// GetLog gets the log entry at index
+func (s *boltStore) GetLog(index uint64, log *raft.Log) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(bucketLogs).Get(indexKey(index))
+		if value == nil {
+			return raft.ErrLogNotFound
+		}
+		return json.Unmarshal(value, log)
+	})
+}
+
+// StoreLog stores a log entry
+func (s *boltStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs stores log entries in one transaction
+func (s *boltStore) StoreLogs(logs []*raft.Log) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketLogs)
+		for _, log := range logs {
+			value, err := json.Marshal(log)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(indexKey(log.Index), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange deletes log entries from min to max, both inclusive
+func (s *boltStore) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// 边遍历边删除会跳过元素，先收集再删除
+		bucket := tx.Bucket(bucketLogs)
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(indexKey(min)); key != nil && binary.BigEndian.Uint64(key) <= max; key, _ = cursor.Next() {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Set stores a value of raft state such as the current term
+func (s *boltStore) Set(key []byte, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketStable).Put(key, value)
+	})
+}
+
+// Get returns the value of key, raft expects errors.ErrKeyNotFound if it's missing
+func (s *boltStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketStable).Get(key)
+		if v == nil {
+			return errors.ErrKeyNotFound
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+// SetUint64 stores a number of raft state
+func (s *boltStore) SetUint64(key []byte, value uint64) error {
+	return s.Set(key, indexKey(value))
+}
+
+// GetUint64 returns the number of key
+func (s *boltStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
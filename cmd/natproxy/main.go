@@ -1,48 +1,218 @@
 package main
 
 import (
+	"bufio"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/jiajunhuang/natproxy/client"
+	"github.com/jiajunhuang/natproxy/logger"
 	"github.com/jiajunhuang/natproxy/tools"
+	"golang.org/x/term"
 )
 
 var (
 	register   = flag.Bool("register", false, "是否注册")
 	login      = flag.Bool("login", false, "是否登录")
 	email      = flag.String("email", "", "注册邮箱")
-	password   = flag.String("password", "", "注册密码")
 	disconnect = flag.Bool("disconnect", false, "是否设置为断开连接")
 	connect    = flag.Bool("connect", false, "是否设置为开启连接")
 )
 
+const usage = `用法: natproxy <命令> [参数]
+
+命令:
+  run                        启动客户端，不写命令时也是启动客户端
+  status                     查看正在运行的客户端和隧道的状态
+  tunnels add <名字> [参数]  添加隧道，参数和run相同，如 -local=127.0.0.1:3000 -type=http
+  tunnels remove <名字>      删除隧道
+  login                      登录并保存token，之后启动客户端不需要再指定token，需要 -email，密码在终端输入
+  logout                     删除保存的token
+  register                   注册，需要 -email，密码在终端输入
+  connect                    通知服务器把本账号设置为正常连接
+  disconnect                 通知服务器把本账号设置为断开连接
+
+参数:
+`
+
 func main() {
-	flag.Parse()
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 
-	if (*register || *login) && (*email == "" || *password == "") {
-		log.Printf("邮箱和密码不能为空")
-		return
+	// 兼容旧的用法，第一个参数是-开头的话按参数解析
+	cmd, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
 	}
 
-	if *register {
-		if err := tools.Register(*email, *password); err != nil {
-			log.Printf("注册失败: %s", err)
-		} else {
-			log.Printf("注册成功")
+	switch cmd {
+	case "", "run":
+		flag.CommandLine.Parse(args)
+		switch {
+		case *register:
+			doRegister()
+		case *login:
+			doLogin(true)
+		case *disconnect:
+			client.SetDisconnect(true)
+		case *connect:
+			client.SetDisconnect(false)
+		default:
+			logger.Info("启动客户端")
+			client.Start()
 		}
+	case "status":
+		flag.CommandLine.Parse(args)
+		showStatus()
+	case "tunnels":
+		doTunnels(args)
+	case "login":
+		flag.CommandLine.Parse(args)
+		doLogin(false)
+	case "logout":
+		flag.CommandLine.Parse(args)
+		doLogout()
+	case "register":
+		flag.CommandLine.Parse(args)
+		doRegister()
+	case "connect", "disconnect":
+		flag.CommandLine.Parse(args)
+		client.SetDisconnect(cmd == "disconnect")
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func doRegister() {
+	password, ok := readCredential()
+	if !ok {
 		return
 	}
 
-	if *login {
-		if token, err := tools.Login(*email, *password); err != nil {
-			log.Printf("登录失败: %s", err)
-		} else {
-			log.Printf("登录成功，token是 %s", token)
-		}
+	if err := tools.Register(*email, password); err != nil {
+		logger.Error("注册失败", "error", err)
+	} else {
+		logger.Info("注册成功")
+	}
+}
+
+// 密码不能放在命令行参数里，其他用户通过ps就能看到。从终端读取时不回显，标准输入不是终端时
+// 读取一行，方便脚本通过管道传入
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "密码: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// 检查邮箱并读取密码，都不为空时返回true
+func readCredential() (string, bool) {
+	if *email == "" {
+		logger.Error("邮箱不能为空")
+		return "", false
+	}
+	password, err := readPassword()
+	if err != nil {
+		logger.Error("无法读取密码", "error", err)
+		return "", false
+	}
+	if password == "" {
+		logger.Error("密码不能为空")
+		return "", false
+	}
+	return password, true
+}
+
+// 登录并保存token，旧的-login用法还会打印token
+func doLogin(printToken bool) {
+	password, ok := readCredential()
+	if !ok {
 		return
 	}
 
-	log.Printf("启动客户端...")
-	client.Start(*connect, *disconnect)
+	token, err := tools.Login(*email, password)
+	if err != nil {
+		logger.Error("登录失败", "error", err)
+		return
+	}
+	if printToken {
+		fmt.Printf("登录成功，token是 %s\n", token)
+	}
+
+	path, err := client.SaveCredential(&client.Credential{Email: *email, Token: token})
+	if err != nil {
+		logger.Error("无法保存token", "error", err)
+		return
+	}
+	logger.Info("登录成功，token已保存，启动客户端时会自动读取", "file", path)
+}
+
+func doLogout() {
+	path, err := client.RemoveCredential()
+	if err != nil {
+		logger.Error("无法删除保存的token", "error", err)
+		return
+	}
+	logger.Info("已删除保存的token", "file", path)
+}
+
+func showStatus() {
+	status, err := client.GetStatus()
+	if err != nil {
+		logger.Error("无法连接正在运行的客户端", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("客户端版本 %s\n", status.Version)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tTYPE\tLOCAL\tTUNNEL\tSERVER\tERROR")
+	for _, t := range status.Tunnels {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.Name, t.State, t.Type, t.Local, t.Tunnel, t.Server, t.Error)
+	}
+	w.Flush()
+}
+
+// tunnels add <名字> [参数] 或者 tunnels remove <名字>
+func doTunnels(args []string) {
+	if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	action, name := args[0], args[1]
+	flag.CommandLine.Parse(args[2:])
+
+	switch action {
+	case "add":
+		t, err := client.AddTunnel(name)
+		if err != nil {
+			logger.Error("无法添加隧道", "name", name, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("已添加隧道", "name", t.Name, "local", t.Local, "type", t.Type)
+	case "remove":
+		if err := client.RemoveTunnel(name); err != nil {
+			logger.Error("无法删除隧道", "name", name, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("已删除隧道", "name", name)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 }
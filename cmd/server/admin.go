@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/cluster"
+	"github.com/jiajunhuang/natproxy/server"
+)
+
+const adminUsage = `usage: natproxys admin <command> [flags]
+
+commands:
+  sessions                      list sessions
+  cluster                       list sessions of the whole cluster
+  traffic                       show traffic of the server and its sessions
+  kick <token>                  disconnect sessions of a token, token can also be the hash shown by sessions
+  kick -session <id>            disconnect a session by the ID shown by sessions
+  tokens                        list tokens managed by admin
+  tokens create [-note] [-port] [-expires] [-scopes]
+                                create a token which is valid without the registry
+  tokens update <token> [-expires] [-scopes]
+                                change expiry or scopes of a token, tokens of the registry too
+  tokens rotate <token> [-grace]
+                                replace a token created by admin with a new one, which keeps its port and
+                                scopes, the new token gets the port once sessions of the old one end. Tokens
+                                of the registry can't be rotated, the registry doesn't know the new token
+  tokens revoke <token>         revoke a token and disconnect its sessions, token can also be the hash shown by
+                                sessions, update, rotate and ports reserve accept the hash too
+  ports reserve <token> <port>  reserve a WAN port for a token
+  ports release <port>          release a reserved port
+  reload                        reload token file
+
+run natproxys admin <command> -h to see flags of a command
+`
+
+// 子命令的flag，只在解析对应的子命令时注册，不会出现在服务器的flag里
+type adminFlags struct {
+	json    bool
+	session int64
+	note    string
+	port    int
+	expires string
+	scopes  string
+	grace   string
+}
+
+// 打印表格还是JSON
+var jsonOutput bool
+
+// 每个子命令用自己的FlagSet，连接服务器用的-adminAddr和-adminToken和服务器共用
+func parseAdminFlags(command string, args []string) *adminFlags {
+	f := &adminFlags{}
+	fs := flag.NewFlagSet("natproxys admin "+command, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), adminUsage)
+		fmt.Fprintf(fs.Output(), "\nflags of %s:\n", command)
+		fs.PrintDefaults()
+	}
+	fs.Var(flag.Lookup("adminAddr").Value, "adminAddr", "admin API address of the running server, the same as its -adminAddr")
+	fs.Var(flag.Lookup("adminToken").Value, "adminToken", "bearer token of the admin API, the same as -adminToken of the server")
+	fs.BoolVar(&f.json, "json", false, "print JSON instead of tables")
+
+	switch command {
+	case "kick":
+		fs.Int64Var(&f.session, "session", 0, "ID of the session to kick, the token argument is omitted then")
+	case "tokens create":
+		fs.StringVar(&f.note, "note", "", "note of the token")
+		fs.IntVar(&f.port, "port", 0, "WAN port reserved for the token, 0 means random")
+		fallthrough
+	case "tokens update":
+		fs.StringVar(&f.expires, "expires", "", "the token expires after this duration such as 720h, never means it doesn't expire")
+		fs.StringVar(&f.scopes, "scopes", "", "comma separated scopes such as tunnel:http,port:20000-20100,group:web, all means full access")
+	case "tokens rotate":
+		fs.StringVar(&f.grace, "grace", "", "the old token is still valid for this duration after rotation, empty means it's revoked at once")
+	}
+
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	jsonOutput = f.json
+	return f
+}
+
+// natproxys admin <command> [args] [flags]
+func runAdmin(args []string) {
+	// 命令和参数在前，flag在后
+	var words []string
+	for len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		words, args = append(words, args[0]), args[1:]
+	}
+	if len(words) == 0 {
+		adminUsageExit()
+	}
+	command := words[0]
+	if (command == "tokens" || command == "ports") && len(words) > 1 {
+		command += " " + words[1]
+	}
+	f := parseAdminFlags(command, args)
+
+	var result interface{}
+	var err error
+	switch words[0] {
+	case "sessions":
+		var sessions []server.SessionInfo
+		if sessions, err = server.AdminSessions(); err == nil {
+			result = sessions
+			printTable(sessionRows(sessions), "ID", "TOKEN", "GROUP", "CLIENT", "VERSION", "TUNNEL", "UPTIME", "CONNS")
+		}
+	case "cluster":
+		var sessions []cluster.Session
+		if sessions, err = server.AdminClusterSessions(); err == nil {
+			result = sessions
+			rows := [][]string{}
+			for _, s := range sessions {
+				uptime := time.Since(s.Since).Truncate(time.Second).String()
+				rows = append(rows, []string{s.ID, s.Node, s.Token, s.Group, s.Client, s.Tunnel, uptime})
+			}
+			printTable(rows, "ID", "NODE", "TOKEN", "GROUP", "CLIENT", "TUNNEL", "UPTIME")
+		}
+	case "traffic":
+		var traffic *server.Traffic
+		if traffic, err = server.AdminTraffic(); err == nil {
+			result = traffic
+			rows := [][]string{}
+			for _, s := range traffic.Sessions {
+				rows = append(rows, []string{strconv.FormatInt(s.ID, 10), s.Token, s.Tunnel, strconv.FormatInt(s.ActiveConns, 10), formatBytes(s.BytesIn), formatBytes(s.BytesOut)})
+			}
+			rows = append(rows, []string{"total", "", "", strconv.FormatInt(traffic.ActiveConns, 10), formatBytes(traffic.BytesIn), formatBytes(traffic.BytesOut)})
+			printTable(rows, "ID", "TOKEN", "TUNNEL", "CONNS", "IN", "OUT")
+		}
+	case "kick":
+		// 按会话ID或者token踢，不从参数的样子猜
+		var req server.KickRequest
+		switch {
+		case f.session != 0 && len(words) == 1:
+			req.ID = f.session
+		case f.session == 0 && len(words) == 2:
+			req.Token = words[1]
+		default:
+			adminUsageExit()
+		}
+		var n int
+		if n, err = server.AdminKick(req); err == nil {
+			result = map[string]int{"kicked": n}
+			printLine("kicked %d session(s)\n", n)
+		}
+	case "tokens":
+		result, err = runTokens(words[1:], f)
+	case "ports":
+		result, err = runPorts(words[1:])
+	case "reload":
+		if err = server.AdminReload(); err == nil {
+			result = map[string]bool{"reloaded": true}
+			printLine("token file reloaded\n")
+		}
+	default:
+		adminUsageExit()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(result)
+	}
+}
+
+func runTokens(words []string, f *adminFlags) (interface{}, error) {
+	switch {
+	case len(words) == 0:
+		tokens, err := server.AdminTokens()
+		if err != nil {
+			return nil, err
+		}
+		printTable(tokenRows(tokens...), tokenHeader...)
+		return tokens, nil
+	case words[0] == "create" && len(words) == 1:
+		entry, err := server.AdminCreateToken(&server.TokenRequest{Note: f.note, Port: f.port, ExpiresIn: f.expires, Scopes: scopeList(f.scopes)})
+		if err != nil {
+			return nil, err
+		}
+		printTable(tokenRows(*entry), tokenHeader...)
+		return entry, nil
+	case words[0] == "update" && len(words) == 2:
+		entry, err := server.AdminUpdateToken(words[1], &server.TokenRequest{ExpiresIn: f.expires, Scopes: scopeList(f.scopes)})
+		if err != nil {
+			return nil, err
+		}
+		printTable(tokenRows(*entry), tokenHeader...)
+		return entry, nil
+	case words[0] == "rotate" && len(words) == 2:
+		entry, err := server.AdminRotateToken(words[1], f.grace)
+		if err != nil {
+			return nil, err
+		}
+		printTable(tokenRows(*entry), tokenHeader...)
+		return entry, nil
+	case words[0] == "revoke" && len(words) == 2:
+		n, err := server.AdminRevokeToken(words[1])
+		if err != nil {
+			return nil, err
+		}
+		printLine("token revoked, kicked %d session(s)\n", n)
+		return map[string]int{"kicked": n}, nil
+	}
+
+	adminUsageExit()
+	return nil, nil
+}
+
+func runPorts(words []string) (interface{}, error) {
+	switch {
+	case len(words) == 3 && words[0] == "reserve":
+		port, err := strconv.Atoi(words[2])
+		if err != nil {
+			adminUsageExit()
+		}
+		entry, err := server.AdminReservePort(words[1], port)
+		if err != nil {
+			return nil, err
+		}
+		printLine("port %d reserved\n", entry.Port)
+		return entry, nil
+	case len(words) == 2 && words[0] == "release":
+		port, err := strconv.Atoi(words[1])
+		if err != nil {
+			adminUsageExit()
+		}
+		if err := server.AdminReleasePort(port); err != nil {
+			return nil, err
+		}
+		printLine("port %d released\n", port)
+		return map[string]int{"released": port}, nil
+	}
+
+	adminUsageExit()
+	return nil, nil
+}
+
+func adminUsageExit() {
+	fmt.Fprint(os.Stderr, adminUsage)
+	os.Exit(2)
+}
+
+func sessionRows(sessions []server.SessionInfo) [][]string {
+	rows := [][]string{}
+	for _, s := range sessions {
+		uptime := time.Since(s.Since).Truncate(time.Second).String()
+		rows = append(rows, []string{strconv.FormatInt(s.ID, 10), s.Token, s.Group, s.Client, s.Version, s.Tunnel, uptime, strconv.FormatInt(s.ActiveConns, 10)})
+	}
+	return rows
+}
+
+// -scopes为空表示不修改，all表示不限制
+func scopeList(scopes string) []string {
+	switch scopes {
+	case "":
+		return nil
+	case "all":
+		return []string{}
+	}
+	return strings.Split(scopes, ",")
+}
+
+var tokenHeader = []string{"TOKEN", "LOCAL", "REVOKED", "PORT", "EXPIRES", "SCOPES", "NOTE"}
+
+func tokenRows(tokens ...server.TokenEntry) [][]string {
+	rows := [][]string{}
+	for _, t := range tokens {
+		port, expires := "", "never"
+		if t.Port != 0 {
+			port = strconv.Itoa(t.Port)
+		}
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{t.Token, strconv.FormatBool(t.Local), strconv.FormatBool(t.Revoked), port, expires, strings.Join(t.Scopes, ","), t.Note})
+	}
+	return rows
+}
+
+// 表格和提示只在非JSON输出时打印
+func printTable(rows [][]string, header ...string) {
+	if jsonOutput {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, h := range header {
+		if i > 0 {
+			fmt.Fprint(w, "\t")
+		}
+		fmt.Fprint(w, h)
+	}
+	fmt.Fprintln(w)
+	for _, row := range rows {
+		for i, col := range row {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, col)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+func printLine(format string, args ...interface{}) {
+	if !jsonOutput {
+		fmt.Printf(format, args...)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
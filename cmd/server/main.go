@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"os"
 
 	"github.com/jiajunhuang/natproxy/server"
 )
@@ -13,6 +14,12 @@ var (
 )
 
 func main() {
+	// natproxys admin <command> 调用正在运行的服务器的管理接口
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		runAdmin(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	server.Start(*addr, *wanip, *bufSize)
@@ -0,0 +1,140 @@
+package compression
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// supported algorithms
+const (
+	None   = ""
+	Snappy = "snappy"
+	Zstd   = "zstd"
+)
+
+// Supported reports whether algo can be used
+func Supported(algo string) bool {
+	return algo == None || algo == Snappy || algo == Zstd
+}
+
+type encoder interface {
+	io.Writer
+	Flush() error
+}
+
+// Conn compresses data written to it and decompresses data read from it, every Write is
+// flushed immediately so interactive traffic is not delayed
+type Conn struct {
+	net.Conn
+
+	readMu  sync.Mutex
+	reader  io.Reader
+	release func() // release resources of decoder
+
+	writeMu sync.Mutex
+	writer  encoder
+	closed  bool
+}
+
+// Wrap conn with given algorithm, conn is returned as is if algo is None
+func Wrap(conn net.Conn, algo string) (net.Conn, error) {
+	switch algo {
+	case None:
+		return conn, nil
+	case Snappy:
+		return &Conn{
+			Conn:    conn,
+			reader:  snappy.NewReader(conn),
+			release: func() {},
+			writer:  snappy.NewBufferedWriter(conn),
+		}, nil
+	case Zstd:
+		decoder, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		writer, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			decoder.Close()
+			return nil, err
+		}
+		return &Conn{Conn: conn, reader: decoder, release: decoder.Close, writer: writer}, nil
+	default:
+		return nil, errors.ErrNotSupport
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.reader == nil {
+		return 0, io.EOF
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := c.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
+
+// CloseWrite finishes the compressed stream and closes the writing side of the underlying conn, so
+// the peer reads EOF after all data
+func (c *Conn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.ErrNotSupport
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	c.closed = true
+	if closer, ok := c.writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return cw.CloseWrite()
+}
+
+// Close the underlying conn first, so blocked Read and Write return, then release the codec
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+
+	c.writeMu.Lock()
+	if !c.closed {
+		c.closed = true
+		if closer, ok := c.writer.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	c.writeMu.Unlock()
+
+	c.readMu.Lock()
+	if c.reader != nil {
+		c.release()
+		c.reader = nil
+	}
+	c.readMu.Unlock()
+
+	return err
+}
@@ -0,0 +1,152 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// 返回一对相连的TCP连接，用同一种算法压缩
+func wrappedPair(t *testing.T, algo string) (*Conn, *Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+
+	w1, err := Wrap(c1, algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := Wrap(c2, algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w1.(*Conn), w2.(*Conn)
+}
+
+var algos = []string{Snappy, Zstd}
+
+// 两个方向同时传输，可压缩和不可压缩的数据都能原样收到
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	payloads := map[string][]byte{
+		"text":   bytes.Repeat([]byte("natproxy compression round trip "), 32*1024),
+		"random": random,
+	}
+
+	for _, algo := range algos {
+		for name, payload := range payloads {
+			c1, c2 := wrappedPair(t, algo)
+
+			errCh := make(chan error, 2)
+			send := func(c *Conn) {
+				// 分多次写，每次写入大小不同
+				for data := payload; len(data) > 0; {
+					n := 1 + rand.Intn(64*1024)
+					if n > len(data) {
+						n = len(data)
+					}
+					if _, err := c.Write(data[:n]); err != nil {
+						errCh <- err
+						return
+					}
+					data = data[n:]
+				}
+				errCh <- c.CloseWrite()
+			}
+			go send(c1)
+			go send(c2)
+
+			for _, c := range []*Conn{c2, c1} {
+				got, err := ioutil.ReadAll(c)
+				if err != nil || !bytes.Equal(got, payload) {
+					t.Errorf("%s %s: got %d bytes, want %d, %v", algo, name, len(got), len(payload), err)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				if err := <-errCh; err != nil {
+					t.Errorf("%s %s: write: %v", algo, name, err)
+				}
+			}
+			c1.Close()
+			c2.Close()
+		}
+	}
+}
+
+// 每次Write之后对端马上能读到，不用等缓冲区满
+func TestWriteFlush(t *testing.T) {
+	for _, algo := range algos {
+		c1, c2 := wrappedPair(t, algo)
+
+		for _, msg := range []string{"a", "ping", "hello world"} {
+			if _, err := c1.Write([]byte(msg)); err != nil {
+				t.Fatalf("%s: %v", algo, err)
+			}
+			c2.SetReadDeadline(time.Now().Add(time.Second * 2))
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(c2, buf); err != nil || string(buf) != msg {
+				t.Errorf("%s: got %q, want %q, %v", algo, buf, msg, err)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+// CloseWrite先写完压缩流再半关闭，对端读到全部数据和EOF之后还可以继续回复
+func TestCloseWrite(t *testing.T) {
+	for _, algo := range algos {
+		c1, c2 := wrappedPair(t, algo)
+
+		if _, err := c1.Write([]byte("request")); err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		if err := c1.CloseWrite(); err != nil {
+			t.Fatalf("%s: close write: %v", algo, err)
+		}
+		if _, err := c1.Write([]byte("more")); err != io.ErrClosedPipe {
+			t.Errorf("%s: write after close write: %v", algo, err)
+		}
+
+		c2.SetReadDeadline(time.Now().Add(time.Second * 2))
+		got, err := ioutil.ReadAll(c2)
+		if err != nil || string(got) != "request" {
+			t.Errorf("%s: got %q, %v", algo, got, err)
+		}
+
+		if _, err := c2.Write([]byte("response")); err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		if err := c2.CloseWrite(); err != nil {
+			t.Fatalf("%s: close write: %v", algo, err)
+		}
+		c1.SetReadDeadline(time.Now().Add(time.Second * 2))
+		got, err = ioutil.ReadAll(c1)
+		if err != nil || string(got) != "response" {
+			t.Errorf("%s: got %q, %v", algo, got, err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
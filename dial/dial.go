@@ -1,14 +1,19 @@
 package dial
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"io"
-	"log"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/logger"
 	"github.com/jiajunhuang/natproxy/pb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -18,6 +23,14 @@ var (
 	socketBufferSize = flag.Int("socketBufferSize", 1024*32, "连接缓冲区大小，越大越快，但是也更吃内存")
 )
 
+// 转发用的缓冲区，连接很多时避免频繁分配
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, *socketBufferSize)
+		return &buf
+	},
+}
+
 // WithServer dial with server
 func WithServer(ctx context.Context, addr string, useTLS bool) (pb.ServerServiceClient, *grpc.ClientConn, error) {
 	var conn *grpc.ClientConn
@@ -30,13 +43,13 @@ func WithServer(ctx context.Context, addr string, useTLS bool) (pb.ServerService
 	}
 
 	if err != nil {
-		log.Printf("failed to connect to server server: %s", err)
+		logger.Error("failed to connect to server", "addr", addr, "error", err)
 		return nil, nil, err
 	}
 
 	select {
 	case <-ctx.Done():
-		log.Printf("ctx had been done, so give up to dial with server")
+		logger.Warn("ctx had been done, so give up to dial with server")
 		return nil, nil, errors.ErrCanceled
 	default:
 	}
@@ -45,22 +58,233 @@ func WithServer(ctx context.Context, addr string, useTLS bool) (pb.ServerService
 	return client, conn, nil
 }
 
+// PinnedTLSConfig returns a TLS config which only accepts the given certificate, the certificate
+// is usually taken from the gRPC connection, so data connections are sure to reach the same server
+func PinnedTLSConfig(cert []byte) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], cert) {
+				return errors.ErrCertMismatch
+			}
+			return nil
+		},
+	}
+}
+
+// CountConn counts bytes read from and written to the conn, it's not goroutine safe
+type CountConn struct {
+	net.Conn
+	ReadCount  int64
+	WriteCount int64
+}
+
+func (c *CountConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.ReadCount += int64(n)
+	return n, err
+}
+
+func (c *CountConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.WriteCount += int64(n)
+	return n, err
+}
+
+// CloseWrite closes the writing side of the underlying conn
+func (c *CountConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// BufferedConn reads from Reader, which is usually a bufio.Reader of Conn with some data buffered
+type BufferedConn struct {
+	net.Conn
+	Reader io.Reader
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// CloseWrite closes the writing side of the underlying conn
+func (c *BufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// CloseWrite closes the writing side of w if it supports half-close, such as *net.TCPConn,
+// *tls.Conn and wrappers of them, so the peer reads EOF but can still send data back
+func CloseWrite(w io.Writer) error {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrNotSupport
+}
+
+// Stats of two joined io.ReadWriteCloser
+type Stats struct {
+	InCount  int64              // bytes copied from c2 to c1
+	OutCount int64              // bytes copied from c1 to c2
+	Closer   io.ReadWriteCloser // the one which stopped sending first, c1 or c2, nil if timed out
+	Err      error              // error interrupted the copying, nil if Closer closed normally
+}
+
+// DefaultHalfCloseTimeout is used if JoinOptions.HalfCloseTimeout is 0
+const DefaultHalfCloseTimeout = time.Minute
+
+// JoinOptions limits how long two joined io.ReadWriteCloser live, zero values mean no limit except
+// HalfCloseTimeout
+type JoinOptions struct {
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"` // no bytes in either direction in this duration, it disables splice
+	MaxLifetime time.Duration `json:"max_lifetime,omitempty"`
+	// after one direction ends, the other one must end in this duration, 0 means
+	// DefaultHalfCloseTimeout, negative means no limit
+	HalfCloseTimeout time.Duration `json:"half_close_timeout,omitempty"`
+}
+
+// Unwrapper is implemented by conn wrappers which don't touch the data, such as the ones doing
+// bookkeeping on Close, so Join can copy between the underlying conns and use splice
+type Unwrapper interface {
+	Unwrap() net.Conn
+}
+
+func unwrap(rw io.ReadWriteCloser) io.ReadWriteCloser {
+	for {
+		u, ok := rw.(Unwrapper)
+		if !ok {
+			return rw
+		}
+		rw = u.Unwrap()
+	}
+}
+
+// 读到数据时记录时间，用于判断是否空闲
+type activeReader struct {
+	io.Reader
+	active *int64
+}
+
+func (r *activeReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(r.active, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// 隐藏ReadFrom和WriteTo，让io.CopyBuffer一定使用传入的缓冲区
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
+
+// copyConn copies from src to dst until EOF. On Linux, if both are *net.TCPConn and active is nil,
+// data is moved by splice(2) in kernel, otherwise a pooled buffer is used. active is updated when
+// some data is read if it's not nil.
+//
+// 转发时两端都是普通TCP连接才会splice：数据连接不加密(客户端-dataTLS=false或者控制通道不用TLS)、
+// 不压缩、TCP隧道、没有设置-connIdleTimeout以及socket的idle timeout。默认开启了dataTLS，这时
+// 服务器和客户端都使用缓冲区复制
+func copyConn(dst io.Writer, src io.Reader, active *int64) (int64, error) {
+	if active == nil {
+		if n, ok, err := splice(dst, src); ok {
+			return n, err
+		}
+		src = readerOnly{src}
+	} else {
+		src = &activeReader{Reader: src, active: active}
+	}
+
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	return io.CopyBuffer(writerOnly{dst}, src, *buf)
+}
+
 // Join two io.ReadWriteCloser and do some operations.
-func Join(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) (inCount int64, outCount int64) {
+func Join(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) Stats {
+	return JoinWith(c1, c2, JoinOptions{})
+}
+
+// JoinWith joins two io.ReadWriteCloser until both directions end or options are exceeded. When one
+// direction ends normally, the writing side of the other one is closed if it supports half-close, and
+// the other direction keeps going until it ends or HalfCloseTimeout; otherwise both are closed
+func JoinWith(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, options JoinOptions) Stats {
+	var stats Stats
+	var once sync.Once
+	var closeOnce sync.Once
+	var halfCloseOnce sync.Once
+	var halfCloseTimer *time.Timer
 	var wait sync.WaitGroup
+
+	stop := func(closer io.ReadWriteCloser, err error) {
+		once.Do(func() {
+			stats.Closer = closer
+			stats.Err = err
+		})
+	}
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			c1.Close()
+			c2.Close()
+		})
+	}
+	defer closeBoth()
+
+	active := time.Now().UnixNano()
+	var tracked *int64 // splice is used only if activity is not tracked
+	if options.IdleTimeout > 0 {
+		tracked = &active
+		var timer *time.Timer
+		timer = time.AfterFunc(options.IdleTimeout, func() {
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&active)))
+			if idle < options.IdleTimeout {
+				timer.Reset(options.IdleTimeout - idle)
+				return
+			}
+			stop(nil, errors.ErrIdleTimeout)
+			closeBoth()
+		})
+		defer timer.Stop()
+	}
+	if options.MaxLifetime > 0 {
+		timer := time.AfterFunc(options.MaxLifetime, func() {
+			stop(nil, errors.ErrMaxLifetime)
+			closeBoth()
+		})
+		defer timer.Stop()
+	}
+
 	pipe := func(to io.ReadWriteCloser, from io.ReadWriteCloser, count *int64) {
-		defer c1.Close()
-		defer c2.Close()
 		defer wait.Done()
 
-		buf := make([]byte, *socketBufferSize)
+		var err error
+		*count, err = copyConn(unwrap(to), unwrap(from), tracked)
+		stop(from, err)
+		if err != nil || CloseWrite(to) != nil {
+			closeBoth()
+			return
+		}
 
-		*count, _ = io.CopyBuffer(to, from, buf)
+		// 对方可能一直不关闭自己的那一边，不能无限等下去
+		halfCloseOnce.Do(func() {
+			timeout := options.HalfCloseTimeout
+			if timeout == 0 {
+				timeout = DefaultHalfCloseTimeout
+			}
+			if timeout > 0 {
+				halfCloseTimer = time.AfterFunc(timeout, closeBoth)
+			}
+		})
 	}
 
 	wait.Add(2)
-	go pipe(c1, c2, &inCount)
-	go pipe(c2, c1, &outCount)
+	go pipe(c1, c2, &stats.InCount)
+	go pipe(c2, c1, &stats.OutCount)
 	wait.Wait()
-	return
+	if halfCloseTimer != nil {
+		halfCloseTimer.Stop()
+	}
+	return stats
 }
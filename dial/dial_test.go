@@ -0,0 +1,381 @@
+package dial
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+// plainConn hides *net.TCPConn, so Join copies with a buffer
+type plainConn struct {
+	net.Conn
+}
+
+// tcpPair returns two ends of a loopback TCP connection
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		b.Fatal("failed to accept")
+	}
+	return c1, c2
+}
+
+// benchmarkJoin sends b.N chunks from one end to the other through Join, wrap decides how the
+// joined conns look like to Join
+func benchmarkJoin(b *testing.B, wrap func(net.Conn) io.ReadWriteCloser, options JoinOptions) {
+	src, in := tcpPair(b)
+	out, dst := tcpPair(b)
+	defer src.Close()
+	defer dst.Close()
+
+	joined := make(chan Stats, 1)
+	go func() { joined <- JoinWith(wrap(in), wrap(out), options) }()
+
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, dst)
+		received <- n
+	}()
+
+	chunk := make([]byte, 32*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := src.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	src.(*net.TCPConn).CloseWrite()
+	n := <-received
+	b.StopTimer()
+
+	dst.Close()
+	<-joined
+	if n != int64(b.N*len(chunk)) {
+		b.Fatalf("received %d bytes, want %d", n, b.N*len(chunk))
+	}
+}
+
+func BenchmarkJoinThroughput(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkJoin(b, func(c net.Conn) io.ReadWriteCloser { return c }, JoinOptions{})
+	})
+	b.Run("buffer", func(b *testing.B) {
+		benchmarkJoin(b, func(c net.Conn) io.ReadWriteCloser { return &plainConn{c} }, JoinOptions{})
+	})
+	b.Run("idle-timeout", func(b *testing.B) {
+		benchmarkJoin(b, func(c net.Conn) io.ReadWriteCloser { return c }, JoinOptions{IdleTimeout: time.Minute})
+	})
+}
+
+// BenchmarkJoinConn joins many short connections, allocations per op show the cost of buffers
+func BenchmarkJoinConn(b *testing.B) {
+	msg := []byte("hello")
+	reply := make([]byte, len(msg))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src, in := net.Pipe()
+		out, dst := net.Pipe()
+
+		joined := make(chan Stats, 1)
+		go func() { joined <- Join(in, out) }()
+
+		if _, err := src.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(dst, reply); err != nil {
+			b.Fatal(err)
+		}
+		src.Close()
+		<-joined
+		dst.Close()
+	}
+}
+
+// joinPair joins two TCP connections, src and dst are the outer ends, wrap decides how the joined
+// conns look like to Join
+func joinPair(t *testing.T, wrap func(net.Conn) io.ReadWriteCloser, options JoinOptions) (net.Conn, net.Conn, io.ReadWriteCloser, <-chan Stats) {
+	src, in := tcpPair(t)
+	out, dst := tcpPair(t)
+
+	c1 := wrap(in)
+	joined := make(chan Stats, 1)
+	go func() { joined <- JoinWith(c1, wrap(out), options) }()
+	return src, dst, c1, joined
+}
+
+func waitJoined(t *testing.T, joined <-chan Stats, timeout time.Duration) Stats {
+	select {
+	case stats := <-joined:
+		return stats
+	case <-time.After(timeout):
+		t.Fatal("join doesn't return")
+		return Stats{}
+	}
+}
+
+var wraps = map[string]func(net.Conn) io.ReadWriteCloser{
+	"splice": func(c net.Conn) io.ReadWriteCloser { return c },
+	"buffer": func(c net.Conn) io.ReadWriteCloser { return &CountConn{Conn: c} },
+}
+
+// 一个方向结束之后另一个方向还能继续传输
+func TestJoinHalfClose(t *testing.T) {
+	for name, wrap := range wraps {
+		t.Run(name, func(t *testing.T) {
+			src, dst, c1, joined := joinPair(t, wrap, JoinOptions{})
+			defer src.Close()
+			defer dst.Close()
+
+			src.Write([]byte("ping"))
+			src.(*net.TCPConn).CloseWrite()
+			got, err := ioutil.ReadAll(dst)
+			if err != nil || string(got) != "ping" {
+				t.Fatalf("dst read %q, %v", got, err)
+			}
+
+			dst.Write([]byte("pong"))
+			dst.Close()
+			got, err = ioutil.ReadAll(src)
+			if err != nil || string(got) != "pong" {
+				t.Fatalf("src read %q, %v", got, err)
+			}
+
+			stats := waitJoined(t, joined, time.Second*5)
+			if stats.Closer != c1 || stats.Err != nil {
+				t.Errorf("closer %v, err %v, want c1 closed normally", stats.Closer, stats.Err)
+			}
+			if stats.OutCount != 4 || stats.InCount != 4 {
+				t.Errorf("out %d, in %d, want 4 and 4", stats.OutCount, stats.InCount)
+			}
+		})
+	}
+}
+
+// 不支持半关闭的连接，一个方向结束时两边都关闭
+func TestJoinWithoutHalfClose(t *testing.T) {
+	src, in := net.Pipe()
+	out, dst := net.Pipe()
+	defer dst.Close()
+
+	joined := make(chan Stats, 1)
+	go func() { joined <- Join(in, out) }()
+	src.Close()
+
+	stats := waitJoined(t, joined, time.Second*5)
+	if stats.Closer != in || stats.Err != nil {
+		t.Errorf("closer %v, err %v, want in closed normally", stats.Closer, stats.Err)
+	}
+	if _, err := dst.Read(make([]byte, 1)); err == nil {
+		t.Error("the other side is not closed")
+	}
+}
+
+// 对方一直不关闭自己的那一边时，超时之后关闭两边
+func TestJoinHalfCloseTimeout(t *testing.T) {
+	for name, wrap := range wraps {
+		t.Run(name, func(t *testing.T) {
+			src, dst, _, joined := joinPair(t, wrap, JoinOptions{HalfCloseTimeout: time.Millisecond * 100})
+			defer src.Close()
+			defer dst.Close()
+
+			start := time.Now()
+			src.(*net.TCPConn).CloseWrite()
+			waitJoined(t, joined, time.Second*5)
+			if elapsed := time.Since(start); elapsed < time.Millisecond*100 {
+				t.Errorf("closed after %v, before the timeout", elapsed)
+			}
+			if _, err := ioutil.ReadAll(src); err != nil {
+				t.Errorf("src is not closed normally: %v", err)
+			}
+		})
+	}
+
+	// 负数表示不限制
+	src, dst, _, joined := joinPair(t, wraps["splice"], JoinOptions{HalfCloseTimeout: -1})
+	defer src.Close()
+	src.(*net.TCPConn).CloseWrite()
+	select {
+	case <-joined:
+		t.Error("join returns without timeout")
+	case <-time.After(time.Millisecond * 300):
+	}
+	dst.Close()
+	waitJoined(t, joined, time.Second*5)
+}
+
+func TestJoinIdleTimeout(t *testing.T) {
+	src, dst, _, joined := joinPair(t, wraps["splice"], JoinOptions{IdleTimeout: time.Millisecond * 200})
+	defer src.Close()
+	defer dst.Close()
+
+	// 一直有数据时不会超时
+	start := time.Now()
+	buf := make([]byte, 1)
+	for i := 0; i < 6; i++ {
+		src.Write([]byte("x"))
+		if _, err := dst.Read(buf); err != nil {
+			t.Fatalf("closed while active: %v", err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	stats := waitJoined(t, joined, time.Second*5)
+	if stats.Err != errors.ErrIdleTimeout || stats.Closer != nil {
+		t.Errorf("closer %v, err %v, want idle timeout", stats.Closer, stats.Err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*600 {
+		t.Errorf("closed after %v while active", elapsed)
+	}
+	if stats.OutCount != 6 {
+		t.Errorf("out %d, want 6", stats.OutCount)
+	}
+}
+
+func TestJoinMaxLifetime(t *testing.T) {
+	src, dst, _, joined := joinPair(t, wraps["splice"], JoinOptions{MaxLifetime: time.Millisecond * 200})
+	defer src.Close()
+	defer dst.Close()
+
+	// 有数据也会在最长存活时间之后关闭
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond * 20):
+				src.Write([]byte("x"))
+			}
+		}
+	}()
+	go io.Copy(ioutil.Discard, dst)
+
+	stats := waitJoined(t, joined, time.Second*5)
+	if stats.Err != errors.ErrMaxLifetime || stats.Closer != nil {
+		t.Errorf("closer %v, err %v, want max lifetime", stats.Closer, stats.Err)
+	}
+}
+
+// 记录每次读取时传入的缓冲区大小
+type recordReader struct {
+	io.Reader
+	size int
+}
+
+func (r *recordReader) Read(b []byte) (int, error) {
+	r.size = len(b)
+	return r.Reader.Read(b)
+}
+
+// 复制时使用池里的缓冲区，而不是每次都分配
+func TestCopyConnBufferPool(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1024)
+	copyOnce := func() {
+		var dst bytes.Buffer
+		r := &recordReader{Reader: bytes.NewReader(data)}
+		if n, err := copyConn(&dst, r, nil); n != int64(len(data)) || err != nil {
+			t.Fatalf("copied %d, %v", n, err)
+		}
+		if r.size != *socketBufferSize {
+			t.Fatalf("read with a buffer of %d bytes, want %d", r.size, *socketBufferSize)
+		}
+	}
+
+	copyOnce()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100; i++ {
+		copyOnce()
+	}
+	runtime.ReadMemStats(&after)
+	// 每次都分配缓冲区的话至少是100个缓冲区，race模式下池会随机丢弃一部分
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(100**socketBufferSize/2) {
+		t.Errorf("allocated %d bytes for 100 copies, buffers are not reused", allocated)
+	}
+}
+
+// unwrapConn is a wrapper which doesn't touch the data, Join copies between the underlying conns
+type unwrapConn struct {
+	net.Conn
+}
+
+func (c *unwrapConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// 两端都是TCP连接时用splice在内核里转发，不从池里取缓冲区
+func TestJoinSplice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("splice is only used on Linux")
+	}
+
+	var drawn int32
+	newBuffer := bufferPool.New
+	defer func() { bufferPool.New = newBuffer }()
+	bufferPool.New = func() interface{} {
+		atomic.AddInt32(&drawn, 1)
+		return newBuffer()
+	}
+	// 清空池子，之后每次取缓冲区都会调用New
+	for atomic.LoadInt32(&drawn) == 0 {
+		bufferPool.Get()
+	}
+
+	tests := []struct {
+		name   string
+		wrap   func(net.Conn) io.ReadWriteCloser
+		splice bool
+	}{
+		{"unwrapped", func(c net.Conn) io.ReadWriteCloser { return &unwrapConn{c} }, true},
+		{"wrapped", func(c net.Conn) io.ReadWriteCloser { return &CountConn{Conn: c} }, false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&drawn, 0)
+		src, dst, _, joined := joinPair(t, tt.wrap, JoinOptions{})
+		src.Write([]byte("ping"))
+		src.(*net.TCPConn).CloseWrite()
+		if got, err := ioutil.ReadAll(dst); err != nil || string(got) != "ping" {
+			t.Fatalf("%s: dst read %q, %v", tt.name, got, err)
+		}
+		dst.Close()
+		ioutil.ReadAll(src)
+		waitJoined(t, joined, time.Second*5)
+		src.Close()
+
+		if n := atomic.LoadInt32(&drawn); (n == 0) != tt.splice {
+			t.Errorf("%s: %d buffers drawn from the pool, splice %v", tt.name, n, tt.splice)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package dial
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+// SocketOptions tunes TCP connections, zero values keep the defaults of Go and OS
+type SocketOptions struct {
+	DialTimeout time.Duration `json:"dial_timeout,omitempty"`
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"` // close connections which read or write nothing in this duration
+	KeepAlive   time.Duration `json:"keep_alive,omitempty"`   // TCP keepalive period, negative means disabled
+	Delay       bool          `json:"delay,omitempty"`        // disable TCP_NODELAY, so small writes are merged
+	ReadBuffer  int           `json:"read_buffer,omitempty"`  // SO_RCVBUF
+	WriteBuffer int           `json:"write_buffer,omitempty"` // SO_SNDBUF
+}
+
+// Dial connects to addr and applies the options
+func (o *SocketOptions) Dial(network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.DialTimeout, KeepAlive: o.KeepAlive}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return o.Apply(conn), nil
+}
+
+// DialTLS connects to addr, applies the options and finishes TLS handshake within DialTimeout
+func (o *SocketOptions) DialTLS(network, addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := o.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if o.DialTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(o.DialTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Apply sets the options to conn, which is usually returned by Accept. The returned conn should be
+// used instead of conn, it closes itself when it's idle
+func (o *SocketOptions) Apply(conn net.Conn) net.Conn {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(!o.Delay)
+		if o.KeepAlive > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(o.KeepAlive)
+		} else if o.KeepAlive < 0 {
+			tcpConn.SetKeepAlive(false)
+		}
+		if o.ReadBuffer > 0 {
+			tcpConn.SetReadBuffer(o.ReadBuffer)
+		}
+		if o.WriteBuffer > 0 {
+			tcpConn.SetWriteBuffer(o.WriteBuffer)
+		}
+	}
+
+	return WithIdleTimeout(conn, o.IdleTimeout)
+}
+
+// idleConn closes the conn if nothing is read or written within timeout
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	active  int64 // unix nano of last read or write
+	idled   int32 // 1 if closed because of idle
+	timer   *time.Timer
+}
+
+// WithIdleTimeout returns a conn which is closed if nothing is read from or written to it within
+// timeout, reading and writing return errors.ErrIdleTimeout after that. timeout <= 0 means no timeout
+func WithIdleTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+
+	c := &idleConn{Conn: conn, timeout: timeout, active: time.Now().UnixNano()}
+	c.timer = time.AfterFunc(timeout, c.check)
+	return c
+}
+
+func (c *idleConn) check() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.active)))
+	if idle < c.timeout {
+		c.timer.Reset(c.timeout - idle)
+		return
+	}
+
+	atomic.StoreInt32(&c.idled, 1)
+	c.Conn.Close()
+}
+
+func (c *idleConn) err(err error) error {
+	if err != nil && atomic.LoadInt32(&c.idled) == 1 {
+		return errors.ErrIdleTimeout
+	}
+	return err
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	}
+	return n, c.err(err)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	}
+	return n, c.err(err)
+}
+
+// CloseWrite closes the writing side of the underlying conn
+func (c *idleConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,21 @@
+package dial
+
+import (
+	"io"
+	"net"
+)
+
+// 两端都是TCP连接时，(*net.TCPConn).ReadFrom会用splice(2)在内核里转发数据，不经过用户态
+func splice(dst io.Writer, src io.Reader) (int64, bool, error) {
+	d, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	s, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := d.ReadFrom(s)
+	return n, true, err
+}
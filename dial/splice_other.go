@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package dial
+
+import (
+	"io"
+)
+
+// 只有Linux支持splice，其他系统使用缓冲区复制
+func splice(dst io.Writer, src io.Reader) (int64, bool, error) {
+	return 0, false, nil
+}
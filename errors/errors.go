@@ -25,4 +25,74 @@ var (
 	ErrTokenNotValid = errors.New("token not valid")
 	// ErrFailedToRegisterAddr failed to register addr
 	ErrFailedToRegisterAddr = errors.New("failed to register addr")
+	// ErrServerShuttingDown server is shutting down
+	ErrServerShuttingDown = errors.New("server is shutting down")
+	// ErrBadProxyHeader bad PROXY protocol header
+	ErrBadProxyHeader = errors.New("bad PROXY protocol header")
+	// ErrTooManyPendingConns too many connections waiting for client
+	ErrTooManyPendingConns = errors.New("too many pending connections")
+	// ErrCertMismatch certificate of data connection is not the same as control channel
+	ErrCertMismatch = errors.New("certificate mismatch")
+	// ErrNoBackend no local backend available
+	ErrNoBackend = errors.New("no local backend available")
+	// ErrBadServerAddr bad server address list
+	ErrBadServerAddr = errors.New("bad server address")
+	// ErrSessionTaken token is online on another server in the cluster
+	ErrSessionTaken = errors.New("token is online on another server")
+	// ErrLockTimeout failed to acquire lock in time
+	ErrLockTimeout = errors.New("lock timeout")
+	// ErrClientTooOld client protocol version is too old
+	ErrClientTooOld = errors.New("client is too old, please upgrade")
+	// ErrRegistryUnavailable failed to query the registry
+	ErrRegistryUnavailable = errors.New("registry unavailable")
+	// ErrBadTunnelName tunnel name is empty
+	ErrBadTunnelName = errors.New("bad tunnel name")
+	// ErrTunnelExists tunnel with the same name already exists
+	ErrTunnelExists = errors.New("tunnel already exists")
+	// ErrTunnelNotFound tunnel not found
+	ErrTunnelNotFound = errors.New("tunnel not found")
+	// ErrDaemonRunning another client is listening on the control socket
+	ErrDaemonRunning = errors.New("another client is running")
+	// ErrNotSocket the control socket path is taken by a file which is not a socket
+	ErrNotSocket = errors.New("path exists and is not a socket")
+	// ErrKicked session is kicked by admin
+	ErrKicked = errors.New("kicked by admin")
+	// ErrSessionNotFound session not found
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrTokenNotFound no token matches the given hash
+	ErrTokenNotFound = errors.New("token not found")
+	// ErrAmbiguousToken more than one token matches the given hash
+	ErrAmbiguousToken = errors.New("more than one token matches the hash, use the token itself")
+	// ErrPortReserved port is reserved by another token
+	ErrPortReserved = errors.New("port is reserved by another token")
+	// ErrPortNotReserved port is not reserved
+	ErrPortNotReserved = errors.New("port is not reserved")
+	// ErrUnauthorized admin token not valid
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrTokenExpired token expired
+	ErrTokenExpired = errors.New("token expired")
+	// ErrPermissionDenied token is not allowed to claim the tunnel, port or group
+	ErrPermissionDenied = errors.New("permission denied by token scopes")
+	// ErrBadScope bad token scope
+	ErrBadScope = errors.New("bad token scope")
+	// ErrTokenRotated token has been rotated already
+	ErrTokenRotated = errors.New("token has been rotated already")
+	// ErrRotatedTokenOnline sessions of the rotated token still hold the reserved port
+	ErrRotatedTokenOnline = errors.New("reserved port is still used by sessions of the rotated token, retry later")
+	// ErrIdleTimeout connection closed because it's idle for too long
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrMaxLifetime connection closed because it lives longer than the max lifetime
+	ErrMaxLifetime = errors.New("max lifetime exceeded")
+	// ErrSessionClosed the session of the client has ended
+	ErrSessionClosed = errors.New("session already closed")
+	// ErrGroupMismatch members of a group use different WAN access rules
+	ErrGroupMismatch = errors.New("group members must use the same WAN allow and deny list")
+	// ErrNoLeader the raft cluster has no leader now
+	ErrNoLeader = errors.New("cluster has no leader")
+	// ErrBadRaftPeers the raft peer list is malformed or doesn't include this server
+	ErrBadRaftPeers = errors.New("bad raft peers")
+	// ErrKeyNotFound the key is not in raft stable store, raft checks this message
+	ErrKeyNotFound = errors.New("not found")
+	// ErrHeartbeatTimeout the peer sends nothing for too long
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
 )
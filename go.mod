@@ -4,8 +4,11 @@ go 1.12
 
 require (
 	github.com/golang/protobuf v1.3.1
+	github.com/golang/snappy v0.0.1
+	github.com/hashicorp/raft v1.1.2
+	github.com/klauspost/compress v1.10.3
 	github.com/libp2p/go-reuseport v0.0.1
-	github.com/stretchr/objx v0.2.0 // indirect
-	golang.org/x/sys v0.0.0-20190614160838-b47fdc937951 // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf
 	google.golang.org/grpc v1.21.1
 )
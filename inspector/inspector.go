@@ -0,0 +1,364 @@
+package inspector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxBodySize is the max bytes of body kept for each request and response
+const MaxBodySize = 1024 * 1024
+
+// Request captured
+type Request struct {
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Proto     string      `json:"proto"`
+	Host      string      `json:"host"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated"` // body is larger than MaxBodySize
+}
+
+// Response captured
+type Response struct {
+	Status    string      `json:"status"`
+	Code      int         `json:"code"`
+	Proto     string      `json:"proto"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated"`
+}
+
+// Exchange is a pair of request and response
+type Exchange struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	DurationMS int64     `json:"duration_ms"`
+	Replay     bool      `json:"replay"` // replayed by inspector
+	Error      string    `json:"error,omitempty"`
+	Request    *Request  `json:"request"`
+	Response   *Response `json:"response,omitempty"`
+}
+
+// Inspector keeps recent exchanges
+type Inspector struct {
+	lock      sync.Mutex
+	local     string // local target address, requests are replayed against it
+	max       int
+	seq       int64
+	exchanges []*Exchange // oldest first
+	client    *http.Client
+}
+
+// New returns an Inspector keeps at most max exchanges
+func New(local string, max int) *Inspector {
+	return &Inspector{
+		local: local,
+		max:   max,
+		client: &http.Client{
+			Timeout: time.Second * 30,
+			// replay the request as is, let the caller see redirects
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// SetDial sets how to connect the local target when replaying, so replayed requests can be
+// sent to any of the local backends
+func (i *Inspector) SetDial(dial func() (net.Conn, error)) {
+	i.client.Transport = &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return dial()
+		},
+	}
+}
+
+// Add an exchange and assign an ID for it
+func (i *Inspector) Add(exchange *Exchange) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.seq++
+	exchange.ID = i.seq
+	i.exchanges = append(i.exchanges, exchange)
+	if len(i.exchanges) > i.max {
+		i.exchanges = i.exchanges[len(i.exchanges)-i.max:]
+	}
+}
+
+// List returns exchanges, newest first
+func (i *Inspector) List() []*Exchange {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	list := make([]*Exchange, 0, len(i.exchanges))
+	for j := len(i.exchanges) - 1; j >= 0; j-- {
+		list = append(list, i.exchanges[j])
+	}
+	return list
+}
+
+// Get exchange by id
+func (i *Inspector) Get(id int64) *Exchange {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for _, exchange := range i.exchanges {
+		if exchange.ID == id {
+			return exchange
+		}
+	}
+	return nil
+}
+
+// captureBody keeps the first MaxBodySize bytes read through it
+type captureBody struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *captureBody) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if n > 0 {
+		keep := n
+		if left := MaxBodySize - c.buf.Len(); keep > left {
+			keep = left
+			c.truncated = true
+		}
+		c.buf.Write(b[:keep])
+	}
+	return n, err
+}
+
+// CaptureRequest replaces body of req so the body will be captured when it's read, the returned
+// Request is complete after the body had been read
+func CaptureRequest(req *http.Request) func() *Request {
+	body := &captureBody{ReadCloser: req.Body}
+	req.Body = body
+	captured := &Request{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Proto:  req.Proto,
+		Host:   req.Host,
+		Header: cloneHeader(req.Header),
+	}
+
+	return func() *Request {
+		captured.Body, captured.Truncated = body.buf.Bytes(), body.truncated
+		return captured
+	}
+}
+
+// CaptureResponse is like CaptureRequest, but for response
+func CaptureResponse(resp *http.Response) func() *Response {
+	body := &captureBody{ReadCloser: resp.Body}
+	resp.Body = body
+	captured := &Response{
+		Status: resp.Status,
+		Code:   resp.StatusCode,
+		Proto:  resp.Proto,
+		Header: cloneHeader(resp.Header),
+	}
+
+	return func() *Response {
+		captured.Body, captured.Truncated = body.buf.Bytes(), body.truncated
+		return captured
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// Replay sends the captured request of exchange to local target again
+func (i *Inspector) Replay(exchange *Exchange) *Exchange {
+	captured := exchange.Request
+	replay := &Exchange{Time: time.Now(), Replay: true, Request: captured}
+	defer i.Add(replay)
+
+	req, err := http.NewRequest(captured.Method, "http://"+i.local+captured.URL, bytes.NewReader(captured.Body))
+	if err != nil {
+		replay.Error = err.Error()
+		return replay
+	}
+	req.Header = cloneHeader(captured.Header)
+	req.Host = captured.Host
+
+	resp, err := i.client.Do(req)
+	replay.DurationMS = int64(time.Since(replay.Time) / time.Millisecond)
+	if err != nil {
+		replay.Error = err.Error()
+		return replay
+	}
+	defer resp.Body.Close()
+
+	done := CaptureResponse(resp)
+	io.Copy(ioutil.Discard, resp.Body)
+	replay.Response = done()
+	return replay
+}
+
+// ServeHTTP serves the web UI and JSON API:
+//
+//	GET  /                          web UI
+//	GET  /api/requests              list exchanges
+//	GET  /api/requests/<id>         get an exchange
+//	POST /api/requests/<id>/replay  replay the request against local target
+func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 其他网站可以通过DNS rebinding让浏览器访问本地地址，所以只接受本机的Host
+	if !loopbackHost(r.Host) {
+		http.Error(w, "forbidden host", http.StatusForbidden)
+		return
+	}
+	// 其他网站的页面也可以直接POST到本机地址，浏览器会带上Origin和Sec-Fetch-Site
+	if !sameOrigin(r) {
+		http.Error(w, "forbidden origin", http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, indexHTML)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/requests"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/api/requests") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if path == "" {
+		writeJSON(w, i.List())
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "replay") {
+		http.NotFound(w, r)
+		return
+	}
+	exchange := i.Get(id)
+	if exchange == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJSON(w, exchange)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// 只保存了请求体的前MaxBodySize字节，重放出去的是另一个请求
+	if exchange.Request.Truncated {
+		http.Error(w, "request body is truncated, can't replay", http.StatusConflict)
+		return
+	}
+	writeJSON(w, i.Replay(exchange))
+}
+
+// loopbackHost reports whether the Host header is localhost or a loopback IP
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// sameOrigin reports whether the request isn't sent by a page of another site
+func sameOrigin(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && loopbackHost(u.Host)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>natproxy inspector</title>
+<style>
+body { font-family: monospace; margin: 1em; }
+.exchange { border-bottom: 1px solid #ccc; padding: .5em 0; }
+pre { background: #f6f6f6; padding: .5em; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h3>natproxy inspector <button onclick="load()">refresh</button></h3>
+<div id="list"></div>
+<script>
+function esc(s) {
+  return String(s).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+}
+function text(b64) {
+  try { return atob(b64 || ""); } catch (e) { return ""; }
+}
+function headers(h) {
+  return Object.keys(h || {}).map(function (k) { return k + ": " + h[k].join(", "); }).join("\n");
+}
+function render(e) {
+  var req = e.request, resp = e.response;
+  var out = '<div class="exchange"><b>#' + e.id + '</b> ' + esc(e.time) + (e.replay ? ' (replay)' : '') +
+    ' ' + e.duration_ms + 'ms <button onclick="replay(' + e.id + ')">replay</button>' +
+    '<pre>' + esc(req.method + ' ' + req.url + ' ' + req.proto + '\nHost: ' + req.host + '\n' + headers(req.header) + '\n\n' + text(req.body)) + '</pre>';
+  if (resp) {
+    out += '<pre>' + esc(resp.proto + ' ' + resp.status + '\n' + headers(resp.header) + '\n\n' + text(resp.body)) + '</pre>';
+  }
+  if (e.error) {
+    out += '<pre>' + esc(e.error) + '</pre>';
+  }
+  return out + '</div>';
+}
+function load() {
+  fetch('/api/requests').then(function (r) { return r.json(); }).then(function (list) {
+    document.getElementById('list').innerHTML = list.map(render).join('');
+  });
+}
+function replay(id) {
+  fetch('/api/requests/' + id + '/replay', {method: 'POST'}).then(function (r) {
+    if (!r.ok) {
+      r.text().then(alert);
+    }
+    load();
+  });
+}
+load();
+</script>
+</body>
+</html>
+`
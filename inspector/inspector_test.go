@@ -0,0 +1,89 @@
+package inspector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestLoopbackHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"127.0.0.1:4040", http.StatusOK},
+		{"localhost:4040", http.StatusOK},
+		{"LOCALHOST", http.StatusOK},
+		{"[::1]:4040", http.StatusOK},
+		{"127.1.2.3", http.StatusOK},
+		{"evil.example.com:4040", http.StatusForbidden},
+		{"localhost.evil.example.com", http.StatusForbidden},
+		{"192.168.1.2:4040", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+
+	i := New("127.0.0.1:8080", 10)
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/requests", nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		i.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("Host %q: got status %d, want %d", tt.host, w.Code, tt.want)
+		}
+	}
+}
+
+// 其他网站的页面不能调用API
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		site   string
+		want   int
+	}{
+		{"", "", http.StatusOK},
+		{"http://127.0.0.1:4040", "same-origin", http.StatusOK},
+		{"http://localhost:4040", "", http.StatusOK},
+		{"", "none", http.StatusOK},
+		{"http://evil.example.com", "", http.StatusForbidden},
+		{"null", "", http.StatusForbidden},
+		{"", "cross-site", http.StatusForbidden},
+		{"http://evil.example.com", "cross-site", http.StatusForbidden},
+	}
+
+	i := New("127.0.0.1:8080", 10)
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/requests", nil)
+		req.Host = "127.0.0.1:4040"
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.site != "" {
+			req.Header.Set("Sec-Fetch-Site", tt.site)
+		}
+		w := httptest.NewRecorder()
+		i.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("Origin %q Sec-Fetch-Site %q: got status %d, want %d", tt.origin, tt.site, w.Code, tt.want)
+		}
+	}
+}
+
+// 请求体被截断的请求不能重放
+func TestReplayTruncated(t *testing.T) {
+	i := New("127.0.0.1:1", 10)
+	i.Add(&Exchange{Request: &Request{Method: http.MethodPost, URL: "/", Body: []byte("part"), Truncated: true}})
+	id := i.List()[0].ID
+
+	req := httptest.NewRequest(http.MethodPost, "/api/requests/"+strconv.FormatInt(id, 10)+"/replay", nil)
+	req.Host = "127.0.0.1:4040"
+	w := httptest.NewRecorder()
+	i.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if n := len(i.List()); n != 1 {
+		t.Errorf("got %d exchanges after refused replay", n)
+	}
+}
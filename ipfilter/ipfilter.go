@@ -0,0 +1,96 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+)
+
+// Filter checks IP against allow and deny CIDR lists. Deny list has higher priority, and if
+// allow list is not empty, only IPs in allow list are allowed.
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// New returns a Filter from comma separated CIDR lists, a single IP is also accepted.
+// It returns nil if both lists are empty.
+func New(allow, deny string) (*Filter, error) {
+	allowList, err := parseList(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyList, err := parseList(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allowList) == 0 && len(denyList) == 0 {
+		return nil, nil
+	}
+	return &Filter{allow: allowList, deny: denyList}, nil
+}
+
+func parseList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether ip is allowed, a nil Filter allows everything
+func (f *Filter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil || contains(f.deny, ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || contains(f.allow, ip)
+}
+
+// AllowedAddr is like Allowed, but takes an address such as the remote address of a connection
+func (f *Filter) AllowedAddr(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return f.Allowed(a.IP)
+	case *net.UDPAddr:
+		return f.Allowed(a.IP)
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return f.Allowed(net.ParseIP(host))
+}
@@ -0,0 +1,119 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		allow, deny string
+		ok          bool
+		isNil       bool
+	}{
+		{"", "", true, true},
+		{" , ", "", true, true},
+		{"10.0.0.0/8", "", true, false},
+		{"", "1.2.3.4", true, false},
+		{"2001:db8::/32, ::1", "", true, false},
+		{"10.0.0.0/33", "", false, false},
+		{"", "not-an-ip", false, false},
+		{"10.0.0.0/8,", "fe80::/10,bad/64", false, false},
+	}
+
+	for _, tt := range tests {
+		f, err := New(tt.allow, tt.deny)
+		if (err == nil) != tt.ok {
+			t.Errorf("New(%q, %q) error = %v, want ok %v", tt.allow, tt.deny, err, tt.ok)
+			continue
+		}
+		if tt.ok && (f == nil) != tt.isNil {
+			t.Errorf("New(%q, %q) = %v, want nil %v", tt.allow, tt.deny, f, tt.isNil)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		allow, deny string
+		ip          string
+		want        bool
+	}{
+		// empty lists allow everything
+		{"", "", "1.2.3.4", true},
+		{"", "", "2001:db8::1", true},
+
+		// allow list only
+		{"10.0.0.0/8", "", "10.1.2.3", true},
+		{"10.0.0.0/8", "", "11.1.2.3", false},
+		{"10.0.0.0/8", "", "2001:db8::1", false},
+		{"1.2.3.4", "", "1.2.3.4", true},
+		{"1.2.3.4", "", "1.2.3.5", false},
+
+		// deny list only
+		{"", "192.168.0.0/16", "192.168.1.1", false},
+		{"", "192.168.0.0/16", "192.169.1.1", true},
+
+		// deny has higher priority than allow
+		{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", false},
+		{"10.0.0.0/8", "10.1.0.0/16", "10.2.2.3", true},
+		{"10.1.2.3", "10.0.0.0/8", "10.1.2.3", false},
+
+		// IPv6
+		{"2001:db8::/32", "", "2001:db8:1::1", true},
+		{"2001:db8::/32", "", "2001:db9::1", false},
+		{"2001:db8::/32", "2001:db8:bad::/48", "2001:db8:bad::1", false},
+		{"::1", "", "::1", true},
+		{"::1", "", "::2", false},
+		{"", "fe80::/10", "fe80::1", false},
+
+		// IPv4-mapped IPv6 addresses match IPv4 networks
+		{"10.0.0.0/8", "", "::ffff:10.1.2.3", true},
+		{"", "10.0.0.0/8", "::ffff:10.1.2.3", false},
+	}
+
+	for _, tt := range tests {
+		f, err := New(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allow %q deny %q: Allowed(%s) = %v, want %v", tt.allow, tt.deny, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedNilIP(t *testing.T) {
+	f, _ := New("", "10.0.0.0/8")
+	if f.Allowed(nil) {
+		t.Error("nil IP is allowed")
+	}
+	var nilFilter *Filter
+	if !nilFilter.Allowed(nil) {
+		t.Error("nil filter denies")
+	}
+}
+
+func TestAllowedAddr(t *testing.T) {
+	f, err := New("10.0.0.0/8,2001:db8::/32", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, true},
+		{&net.TCPAddr{IP: net.ParseIP("11.0.0.1"), Port: 80}, false},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, true},
+		{&net.IPAddr{IP: net.ParseIP("10.0.0.1")}, false}, // no port, can't be parsed
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := f.AllowedAddr(tt.addr); got != tt.want {
+			t.Errorf("AllowedAddr(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package logger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logFormat = flag.String("logFormat", "logfmt", "log format, logfmt or json")
+	logLevel  = flag.String("logLevel", "info", "log level, debug, info, warn or error")
+	logSecret = flag.Bool("logSecret", false, "print secrets such as token in log, only for debugging")
+)
+
+// Level log level
+type Level int
+
+// log levels
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel parse level from string, unknown level will be treated as info
+func ParseLevel(s string) Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel
+	case "warn", "warning":
+		return WarnLevel
+	case "error":
+		return ErrorLevel
+	default:
+		return InfoLevel
+	}
+}
+
+// keys whose value should never be printed as is
+var secretKeys = map[string]bool{
+	"token":    true,
+	"password": true,
+}
+
+var (
+	lock   sync.Mutex
+	output io.Writer = os.Stderr
+	once   sync.Once
+	level  Level
+	asJSON bool
+	redact bool
+)
+
+// flags are parsed after package initialization, so read them when logging for the first time
+func setup() {
+	once.Do(func() {
+		level = ParseLevel(*logLevel)
+		asJSON = *logFormat == "json"
+		redact = !*logSecret
+	})
+}
+
+// SetOutput set output of logs
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	output = w
+}
+
+// TokenHash returns a short, stable and non-reversible representation of a token
+func TokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// Logger carries fields which will be attached to every log line
+type Logger struct {
+	fields []interface{}
+}
+
+var root = &Logger{}
+
+// With returns a logger with extra key-value pairs
+func With(kv ...interface{}) *Logger {
+	return root.With(kv...)
+}
+
+// With returns a child logger with extra key-value pairs
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+// Debug log at debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(DebugLevel, msg, kv) }
+
+// Info log at info level
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(InfoLevel, msg, kv) }
+
+// Warn log at warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(WarnLevel, msg, kv) }
+
+// Error log at error level
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(ErrorLevel, msg, kv) }
+
+// Fatal log at error level and exit
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+// Debug log at debug level
+func Debug(msg string, kv ...interface{}) { root.log(DebugLevel, msg, kv) }
+
+// Info log at info level
+func Info(msg string, kv ...interface{}) { root.log(InfoLevel, msg, kv) }
+
+// Warn log at warn level
+func Warn(msg string, kv ...interface{}) { root.log(WarnLevel, msg, kv) }
+
+// Error log at error level
+func Error(msg string, kv ...interface{}) { root.log(ErrorLevel, msg, kv) }
+
+// Fatal log at error level and exit
+func Fatal(msg string, kv ...interface{}) {
+	root.log(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(lvl Level, msg string, kv []interface{}) {
+	setup()
+	if lvl < level {
+		return
+	}
+
+	keys := []string{"time", "level", "msg"}
+	values := []interface{}{time.Now().Format(time.RFC3339Nano), lvl.String(), msg}
+	pairs := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(pairs) {
+			value = pairs[i+1]
+		}
+		if redact {
+			value = redactValue(key, value)
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		} else if s, ok := value.(fmt.Stringer); ok {
+			value = s.String()
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	var buf bytes.Buffer
+	if asJSON {
+		encodeJSON(&buf, keys, values)
+	} else {
+		encodeLogfmt(&buf, keys, values)
+	}
+	buf.WriteByte('\n')
+
+	lock.Lock()
+	defer lock.Unlock()
+	output.Write(buf.Bytes())
+}
+
+// 键是secretKeys的值替换为hash，map里的值也一样
+func redactValue(key string, value interface{}) interface{} {
+	if secretKeys[key] {
+		return TokenHash(fmt.Sprint(value))
+	}
+
+	switch m := value.(type) {
+	case map[string]string:
+		redacted := make(map[string]string, len(m))
+		for k, v := range m {
+			redacted[k] = redactValue(k, v).(string)
+		}
+		return redacted
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			redacted[k] = redactValue(k, v)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+func encodeJSON(buf *bytes.Buffer, keys []string, values []interface{}) {
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(values[i])
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(values[i]))
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+func encodeLogfmt(buf *bytes.Buffer, keys []string, values []interface{}) {
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+
+		v := fmt.Sprint(values[i])
+		if v == "" || strings.ContainsAny(v, " =\"\t\r\n") {
+			v = fmt.Sprintf("%q", v)
+		}
+		buf.WriteString(v)
+	}
+}
@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// 用JSON格式记录一行日志，返回解析后的字段
+func logJSON(t *testing.T, l *Logger, kv ...interface{}) map[string]interface{} {
+	setup()
+	var buf bytes.Buffer
+	oldOutput, oldJSON, oldRedact := output, asJSON, redact
+	SetOutput(&buf)
+	asJSON, redact = true, true
+	defer func() {
+		SetOutput(oldOutput)
+		asJSON, redact = oldJSON, oldRedact
+	}()
+
+	l.Info("test", kv...)
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("bad log line %q: %v", buf.String(), err)
+	}
+	return fields
+}
+
+func TestRedact(t *testing.T) {
+	const secret = "s3cr3t-value"
+	hash := TokenHash(secret)
+
+	tests := []struct {
+		name   string
+		logger *Logger
+		kv     []interface{}
+		key    string
+		want   interface{}
+	}{
+		{"token", root, []interface{}{"token", secret}, "token", hash},
+		{"password", root, []interface{}{"password", secret}, "password", hash},
+		{"other key", root, []interface{}{"tunnel", secret}, "tunnel", secret},
+		{"with", With("token", secret), nil, "token", hash},
+		{"nested with", With("session", 1).With("password", secret), []interface{}{"addr", "x"}, "password", hash},
+		{"stringer", root, []interface{}{"token", stringer(secret)}, "token", hash},
+		{"error", root, []interface{}{"token", fmt.Errorf(secret)}, "token", hash},
+		{"error key", root, []interface{}{"error", fmt.Errorf("bad token")}, "error", "bad token"},
+		{"map", root, []interface{}{"request", map[string]interface{}{"token": secret, "port": "80"}}, "request", map[string]interface{}{"token": hash, "port": "80"}},
+		{"string map", root, []interface{}{"request", map[string]string{"password": secret}}, "request", map[string]interface{}{"password": hash}},
+		{"nested map", root, []interface{}{"request", map[string]interface{}{"auth": map[string]string{"token": secret}}}, "request", map[string]interface{}{"auth": map[string]interface{}{"token": hash}}},
+	}
+	for _, tt := range tests {
+		fields := logJSON(t, tt.logger, tt.kv...)
+		if got := fmt.Sprint(fields[tt.key]); got != fmt.Sprint(tt.want) {
+			t.Errorf("%s: %s=%s, want %v", tt.name, tt.key, got, tt.want)
+		}
+		line, _ := json.Marshal(fields)
+		if tt.key != "tunnel" && strings.Contains(string(line), secret) {
+			t.Errorf("%s: secret in log line %s", tt.name, line)
+		}
+	}
+}
+
+// -logSecret打开时原样输出
+func TestNoRedact(t *testing.T) {
+	setup()
+	var buf bytes.Buffer
+	oldOutput, oldRedact := output, redact
+	SetOutput(&buf)
+	redact = false
+	defer func() {
+		SetOutput(oldOutput)
+		redact = oldRedact
+	}()
+
+	Info("test", "token", "t1")
+	if !strings.Contains(buf.String(), "token=t1") {
+		t.Errorf("token is redacted: %s", buf.String())
+	}
+}
+
+type stringer string
+
+func (s stringer) String() string {
+	return string(s)
+}
@@ -2,7 +2,7 @@
 
 go fmt ./...
 go vet ./...
-protoc -I pb/ natproxy.proto --go_out=plugins=grpc:pb/
+make proto
 version=`grep version client/client.go | head -n 1 | tr " " "\n" | tail -n 1 | tr -d '"'`
 go build -o bin/natproxys cmd/server/main.go
 
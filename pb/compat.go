@@ -0,0 +1,149 @@
+package pb
+
+import (
+	proto "github.com/golang/protobuf/proto"
+)
+
+// 兼容旧版本的消息格式：旧版本只认识type和data字段，data根据type是字符串或者序列化后的消息。
+// 新版本使用payload，收到消息时先转成payload形式，发给旧版本时转成type和data形式
+
+// Typed converts a legacy request to the typed form, typed requests are returned as is, so are
+// requests of unknown types
+func (m *MsgRequest) Typed() (*MsgRequest, error) {
+	if m.Payload != nil {
+		return m, nil
+	}
+
+	typed := &MsgRequest{Type: m.Type}
+	switch m.Type {
+	case MsgType_Handshake:
+		hs := &HandshakeInfo{}
+		if err := proto.Unmarshal(m.Data, hs); err != nil {
+			return nil, err
+		}
+		typed.Payload = &MsgRequest_Handshake{Handshake: hs}
+	case MsgType_Report:
+		info := &ClientInfo{}
+		if err := proto.Unmarshal(m.Data, info); err != nil {
+			return nil, err
+		}
+		typed.Payload = &MsgRequest_Report{Report: info}
+	case MsgType_DisConnect:
+		typed.Payload = &MsgRequest_Disconnect{Disconnect: &Disconnect{}}
+	case MsgType_Ping:
+		ping := &PingPong{}
+		if err := proto.Unmarshal(m.Data, ping); err != nil {
+			return nil, err
+		}
+		typed.Payload = &MsgRequest_Ping{Ping: ping}
+	case MsgType_Error:
+		info := &ErrorInfo{}
+		if err := proto.Unmarshal(m.Data, info); err != nil {
+			return nil, err
+		}
+		typed.Payload = &MsgRequest_Error{Error: info}
+	default:
+		return m, nil
+	}
+
+	return typed, nil
+}
+
+// WithLegacy fills the legacy fields of a typed request and keeps the payload, so both old and
+// new servers understand it. Clients use it before they know the version of server
+func (m *MsgRequest) WithLegacy() (*MsgRequest, error) {
+	var err error
+	switch p := m.Payload.(type) {
+	case *MsgRequest_Handshake:
+		m.Type = MsgType_Handshake
+		m.Data, err = proto.Marshal(p.Handshake)
+	case *MsgRequest_Report:
+		m.Type = MsgType_Report
+		m.Data, err = proto.Marshal(p.Report)
+	case *MsgRequest_Disconnect:
+		m.Type = MsgType_DisConnect
+	case *MsgRequest_Ping:
+		m.Type = MsgType_Ping
+		m.Data, err = proto.Marshal(p.Ping)
+	case *MsgRequest_Error:
+		m.Type = MsgType_Error
+		m.Data, err = proto.Marshal(p.Error)
+	}
+
+	return m, err
+}
+
+// Typed converts a legacy response to the typed form, typed responses are returned as is, so are
+// responses of unknown types
+func (m *MsgResponse) Typed() (*MsgResponse, error) {
+	if m.Payload != nil {
+		return m, nil
+	}
+
+	typed := &MsgResponse{Type: m.Type}
+	switch m.Type {
+	case MsgType_Connect:
+		typed.Payload = &MsgResponse_Connect{Connect: &ConnectRequest{
+			Addr:    string(m.Data),
+			SrcAddr: m.SrcAddr,
+			DstAddr: m.DstAddr,
+			ConnId:  m.ConnId,
+		}}
+	case MsgType_WANAddr:
+		typed.Payload = &MsgResponse_WanAddr{WanAddr: &WANAddrAssigned{Addr: string(m.Data)}}
+	case MsgType_Handshake:
+		hs := &HandshakeInfo{}
+		if err := proto.Unmarshal(m.Data, hs); err != nil {
+			return nil, err
+		}
+		typed.Payload = &MsgResponse_Handshake{Handshake: hs}
+	case MsgType_Reconnect:
+		typed.Payload = &MsgResponse_Reconnect{Reconnect: &ReconnectRequest{}}
+	case MsgType_Ping:
+		ping := &PingPong{}
+		if err := proto.Unmarshal(m.Data, ping); err != nil {
+			return nil, err
+		}
+		typed.Payload = &MsgResponse_Ping{Ping: ping}
+	case MsgType_Error:
+		info := &ErrorInfo{}
+		if err := proto.Unmarshal(m.Data, info); err != nil {
+			return nil, err
+		}
+		typed.Payload = &MsgResponse_Error{Error: info}
+	default:
+		return m, nil
+	}
+
+	return typed, nil
+}
+
+// Legacy converts a typed response to the legacy form, for clients which don't negotiate typed
+// messages in handshake
+func (m *MsgResponse) Legacy() (*MsgResponse, error) {
+	legacy := &MsgResponse{Type: m.Type}
+	var err error
+	switch p := m.Payload.(type) {
+	case *MsgResponse_Connect:
+		legacy.Type = MsgType_Connect
+		legacy.Data = []byte(p.Connect.Addr)
+		legacy.SrcAddr, legacy.DstAddr, legacy.ConnId = p.Connect.SrcAddr, p.Connect.DstAddr, p.Connect.ConnId
+	case *MsgResponse_WanAddr:
+		legacy.Type, legacy.Data = MsgType_WANAddr, []byte(p.WanAddr.Addr)
+	case *MsgResponse_Handshake:
+		legacy.Type = MsgType_Handshake
+		legacy.Data, err = proto.Marshal(p.Handshake)
+	case *MsgResponse_Reconnect:
+		legacy.Type = MsgType_Reconnect
+	case *MsgResponse_Error:
+		legacy.Type = MsgType_Error
+		legacy.Data, err = proto.Marshal(p.Error)
+	case *MsgResponse_Ping:
+		legacy.Type = MsgType_Ping
+		legacy.Data, err = proto.Marshal(p.Ping)
+	default:
+		return m, nil
+	}
+
+	return legacy, err
+}
@@ -0,0 +1,137 @@
+package pb
+
+import (
+	"testing"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+func marshal(t *testing.T, m proto.Message) []byte {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// 旧格式的请求转成新格式再转回旧格式，type和data不变
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		legacy  *MsgRequest
+		payload isMsgRequest_Payload
+	}{
+		{
+			&MsgRequest{Type: MsgType_Handshake, Data: marshal(t, &HandshakeInfo{ProtocolVersion: 1, Features: []string{"conn-id", "heartbeat"}})},
+			&MsgRequest_Handshake{Handshake: &HandshakeInfo{ProtocolVersion: 1, Features: []string{"conn-id", "heartbeat"}}},
+		},
+		{
+			&MsgRequest{Type: MsgType_Report, Data: marshal(t, &ClientInfo{Os: "linux", Arch: "amd64", Version: "0.1.0"})},
+			&MsgRequest_Report{Report: &ClientInfo{Os: "linux", Arch: "amd64", Version: "0.1.0"}},
+		},
+		{
+			&MsgRequest{Type: MsgType_DisConnect},
+			&MsgRequest_Disconnect{Disconnect: &Disconnect{}},
+		},
+		{
+			&MsgRequest{Type: MsgType_Ping, Data: marshal(t, &PingPong{UnixNano: 42})},
+			&MsgRequest_Ping{Ping: &PingPong{UnixNano: 42}},
+		},
+		{
+			&MsgRequest{Type: MsgType_Error, Data: marshal(t, &ErrorInfo{Code: ErrorCode_TokenNotValid, Message: "token not valid"})},
+			&MsgRequest_Error{Error: &ErrorInfo{Code: ErrorCode_TokenNotValid, Message: "token not valid"}},
+		},
+	}
+
+	for _, tt := range tests {
+		typed, err := proto.Clone(tt.legacy).(*MsgRequest).Typed()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.legacy.Type, err)
+		}
+		if want := (&MsgRequest{Type: tt.legacy.Type, Payload: tt.payload}); !proto.Equal(typed, want) {
+			t.Errorf("%s: typed %v, want %v", tt.legacy.Type, typed, want)
+		}
+
+		legacy, err := typed.WithLegacy()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.legacy.Type, err)
+		}
+		if legacy.Payload == nil {
+			t.Errorf("%s: payload is dropped", tt.legacy.Type)
+		}
+		legacy.Payload = nil
+		if !proto.Equal(legacy, tt.legacy) {
+			t.Errorf("%s: legacy %v, want %v", tt.legacy.Type, legacy, tt.legacy)
+		}
+	}
+}
+
+// 旧格式的响应转成新格式再转回旧格式，不变
+func TestResponseRoundTrip(t *testing.T) {
+	tests := []struct {
+		legacy  *MsgResponse
+		payload isMsgResponse_Payload
+	}{
+		{
+			&MsgResponse{Type: MsgType_Connect, Data: []byte("1.2.3.4:5678"), SrcAddr: "5.6.7.8:9", DstAddr: "1.2.3.4:80", ConnId: 7},
+			&MsgResponse_Connect{Connect: &ConnectRequest{Addr: "1.2.3.4:5678", SrcAddr: "5.6.7.8:9", DstAddr: "1.2.3.4:80", ConnId: 7}},
+		},
+		{
+			&MsgResponse{Type: MsgType_WANAddr, Data: []byte("1.2.3.4:80")},
+			&MsgResponse_WanAddr{WanAddr: &WANAddrAssigned{Addr: "1.2.3.4:80"}},
+		},
+		{
+			&MsgResponse{Type: MsgType_Handshake, Data: marshal(t, &HandshakeInfo{ProtocolVersion: 1, Features: []string{"heartbeat"}, HeartbeatTimeoutMs: 90000})},
+			&MsgResponse_Handshake{Handshake: &HandshakeInfo{ProtocolVersion: 1, Features: []string{"heartbeat"}, HeartbeatTimeoutMs: 90000}},
+		},
+		{
+			&MsgResponse{Type: MsgType_Reconnect},
+			&MsgResponse_Reconnect{Reconnect: &ReconnectRequest{}},
+		},
+		{
+			&MsgResponse{Type: MsgType_Ping, Data: marshal(t, &PingPong{UnixNano: 42})},
+			&MsgResponse_Ping{Ping: &PingPong{UnixNano: 42}},
+		},
+		{
+			&MsgResponse{Type: MsgType_Error, Data: marshal(t, &ErrorInfo{Code: ErrorCode_ServerShuttingDown, Message: "server is shutting down", Retryable: true})},
+			&MsgResponse_Error{Error: &ErrorInfo{Code: ErrorCode_ServerShuttingDown, Message: "server is shutting down", Retryable: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		typed, err := proto.Clone(tt.legacy).(*MsgResponse).Typed()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.legacy.Type, err)
+		}
+		if want := (&MsgResponse{Type: tt.legacy.Type, Payload: tt.payload}); !proto.Equal(typed, want) {
+			t.Errorf("%s: typed %v, want %v", tt.legacy.Type, typed, want)
+		}
+
+		legacy, err := typed.Legacy()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.legacy.Type, err)
+		}
+		if !proto.Equal(legacy, tt.legacy) {
+			t.Errorf("%s: legacy %v, want %v", tt.legacy.Type, legacy, tt.legacy)
+		}
+	}
+}
+
+// 不认识的类型和已经是新格式的消息原样返回
+func TestTypedUnknown(t *testing.T) {
+	req := &MsgRequest{Type: MsgType(99), Data: []byte("data")}
+	if typed, err := req.Typed(); err != nil || typed != req {
+		t.Errorf("unknown request: %v, %v", typed, err)
+	}
+	req = &MsgRequest{Type: MsgType_Ping, Payload: &MsgRequest_Ping{Ping: &PingPong{UnixNano: 1}}}
+	if typed, err := req.Typed(); err != nil || typed != req {
+		t.Errorf("typed request: %v, %v", typed, err)
+	}
+
+	resp := &MsgResponse{Type: MsgType(99), Data: []byte("data")}
+	if typed, err := resp.Typed(); err != nil || typed != resp {
+		t.Errorf("unknown response: %v, %v", typed, err)
+	}
+	if _, err := (&MsgResponse{Type: MsgType_Ping, Data: []byte{0xff}}).Typed(); err == nil {
+		t.Error("bad ping data is accepted")
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+// Version of the control protocol, increase it when old clients can't work with the server
+const Version = 1
+
+// features which can be negotiated in handshake
+const (
+	FeatureConnID        = "conn-id"        // client sends connection id at the beginning of data connections
+	FeatureDataTLS       = "data-tls"       // data connections are encrypted by TLS
+	FeatureCompression   = "compression"    // data connections can be compressed
+	FeatureReconnect     = "reconnect"      // server asks client to reconnect when it's shutting down
+	FeatureGroup         = "group"          // clients can share a WAN address in a group
+	FeatureTypedMessages = "typed-messages" // messages use typed payload instead of type and data
+	FeatureHeartbeat     = "heartbeat"      // client pings the server periodically, both sides drop a silent peer
+
+	// 还没有实现，这个版本不会声明支持，协商结果里也就不会有它们
+	FeatureMux = "mux" // multiple WAN connections share one data connection
+	FeatureUDP = "udp" // UDP tunnels
+)
+
+// Features supported by this build
+var Features = []string{FeatureConnID, FeatureDataTLS, FeatureCompression, FeatureReconnect, FeatureGroup, FeatureTypedMessages, FeatureHeartbeat}
+
+// Negotiate returns features supported by both sides, in the order of local
+func Negotiate(local, remote []string) []string {
+	common := []string{}
+	for _, feature := range local {
+		if Has(remote, feature) {
+			common = append(common, feature)
+		}
+	}
+	return common
+}
+
+// Has reports whether feature is in features
+func Has(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+// versions of PROXY protocol
+const (
+	V1 = "v1"
+	V2 = "v2"
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+	v2FamTCP4  = 0x11
+	v2FamTCP6  = 0x21
+
+	v1MaxLength = 107
+	v2MaxLength = 4096 // addresses and TLVs, much larger than any real header
+)
+
+// WriteHeader writes a PROXY protocol header of given version
+func WriteHeader(w io.Writer, version string, src, dst *net.TCPAddr) error {
+	var header []byte
+	switch version {
+	case V1:
+		header = v1Header(src, dst)
+	case V2:
+		header = v2Header(src, dst)
+	default:
+		return errors.ErrNotSupport
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+func v1Header(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", v6String(src.IP), v6String(dst.IP), src.Port, dst.Port))
+}
+
+// TCP6的两个地址都必须是IPv6格式，IPv4地址写成IPv4-mapped形式
+func v6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func v2Header(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+
+	if src == nil || dst == nil {
+		buf.Write([]byte{v2CmdLocal, 0, 0, 0})
+		return buf.Bytes()
+	}
+
+	buf.WriteByte(v2CmdProxy)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil && dstIP != nil {
+		buf.WriteByte(v2FamTCP4)
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+	} else {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		buf.WriteByte(v2FamTCP6)
+		binary.Write(&buf, binary.BigEndian, uint16(36))
+	}
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+
+	return buf.Bytes()
+}
+
+// ReadHeader reads a PROXY protocol v1 or v2 header, src and dst are nil if the header
+// says the connection is not proxied(UNKNOWN or LOCAL)
+func ReadHeader(r *bufio.Reader) (src, dst *net.TCPAddr, err error) {
+	peek, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(peek, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readV1(r)
+	}
+
+	return nil, nil, errors.ErrBadProxyHeader
+}
+
+func readV1(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.ErrBadProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.ErrBadProxyHeader
+	}
+
+	v6 := fields[1] == "TCP6"
+	src, err := parseAddr(fields[2], fields[4], v6)
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseAddr(fields[3], fields[5], v6)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+// TCP4的地址必须是点分十进制，TCP6的地址必须是IPv6格式
+func parseAddr(ip, port string, v6 bool) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || strings.Contains(ip, ":") != v6 {
+		return nil, errors.ErrBadProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.ErrBadProxyHeader
+	}
+	addr.Port = int(p)
+
+	return addr, nil
+}
+
+func readV2(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	cmd, fam := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+	if length > v2MaxLength {
+		return nil, nil, errors.ErrBadProxyHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if cmd == v2CmdLocal {
+		return nil, nil, nil
+	}
+	if cmd != v2CmdProxy {
+		return nil, nil, errors.ErrBadProxyHeader
+	}
+
+	var ipLen int
+	switch fam {
+	case v2FamTCP4:
+		ipLen = net.IPv4len
+	case v2FamTCP6:
+		ipLen = net.IPv6len
+	default:
+		// other families such as UDP or unix socket, treat as not proxied
+		return nil, nil, nil
+	}
+	if len(payload) < ipLen*2+4 {
+		return nil, nil, errors.ErrBadProxyHeader
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : ipLen*2]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2+2:])),
+	}
+	return src, dst, nil
+}
+
+// Conn is a net.Conn which addresses are taken from PROXY protocol header
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	src    net.Addr
+	dst    net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite closes the writing side of the underlying conn
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrNotSupport
+}
+
+// RemoteAddr returns the source address in header
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.src
+}
+
+// LocalAddr returns the destination address in header
+func (c *Conn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+// Accept reads PROXY protocol header from conn in given timeout, and returns a conn
+// reports the real addresses
+func Accept(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	src, dst, err := ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &Conn{Conn: conn, reader: reader, src: conn.RemoteAddr(), dst: conn.LocalAddr()}
+	if src != nil {
+		c.src, c.dst = src, dst
+	}
+	return c, nil
+}
+
+// ParseTCPAddr returns nil if addr is not a valid TCP address
+func ParseTCPAddr(addr string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	tcpAddr, err := parseAddr(host, port, strings.Contains(host, ":"))
+	if err != nil {
+		return nil
+	}
+	return tcpAddr
+}
@@ -0,0 +1,180 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr := ParseTCPAddr(s)
+	if addr == nil {
+		panic("bad address " + s)
+	}
+	return addr
+}
+
+func TestV1Header(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		want     string
+	}{
+		{"1.2.3.4:1000", "5.6.7.8:80", "PROXY TCP4 1.2.3.4 5.6.7.8 1000 80\r\n"},
+		{"[2001:db8::1]:1000", "[2001:db8::2]:80", "PROXY TCP6 2001:db8::1 2001:db8::2 1000 80\r\n"},
+		{"1.2.3.4:1000", "[2001:db8::2]:80", "PROXY TCP6 ::ffff:1.2.3.4 2001:db8::2 1000 80\r\n"},
+		{"[2001:db8::1]:1000", "5.6.7.8:80", "PROXY TCP6 2001:db8::1 ::ffff:5.6.7.8 1000 80\r\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteHeader(&buf, V1, tcpAddr(tt.src), tcpAddr(tt.dst)); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("v1 header of %s -> %s = %q, want %q", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst string
+	}{
+		{"1.2.3.4:1000", "5.6.7.8:80"},
+		{"[2001:db8::1]:65535", "[2001:db8::2]:1"},
+		{"1.2.3.4:1000", "[2001:db8::2]:80"},
+	}
+
+	for _, version := range []string{V1, V2} {
+		for _, tt := range tests {
+			src, dst := tcpAddr(tt.src), tcpAddr(tt.dst)
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, version, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("payload")
+
+			r := bufio.NewReader(&buf)
+			gotSrc, gotDst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("%s %s -> %s: %v", version, tt.src, tt.dst, err)
+			}
+			if !gotSrc.IP.Equal(src.IP) || gotSrc.Port != src.Port || !gotDst.IP.Equal(dst.IP) || gotDst.Port != dst.Port {
+				t.Errorf("%s: got %s -> %s, want %s -> %s", version, gotSrc, gotDst, src, dst)
+			}
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("%s: data after header = %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestNotProxied(t *testing.T) {
+	for _, version := range []string{V1, V2} {
+		var buf bytes.Buffer
+		if err := WriteHeader(&buf, version, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		src, dst, err := ReadHeader(bufio.NewReader(&buf))
+		if err != nil || src != nil || dst != nil {
+			t.Errorf("%s: got %v %v %v, want not proxied", version, src, dst, err)
+		}
+	}
+}
+
+// v2 header with given command, family and payload length, payload is filled with zero
+func v2Raw(cmd, fam byte, length int, payload int) []byte {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+	buf.WriteByte(cmd)
+	buf.WriteByte(fam)
+	binary.Write(&buf, binary.BigEndian, uint16(length))
+	buf.Write(make([]byte, payload))
+	return buf.Bytes()
+}
+
+func TestBadHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		err    error // nil means any error
+	}{
+		{"empty", nil, io.EOF},
+		{"not PROXY", []byte("GET / HTTP/1.1\r\n\r\n"), errors.ErrBadProxyHeader},
+		{"v1 truncated", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000"), nil},
+		{"v1 without CR", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 80\n"), errors.ErrBadProxyHeader},
+		{"v1 oversized", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), errors.ErrBadProxyHeader},
+		{"v1 missing field", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000\r\n"), errors.ErrBadProxyHeader},
+		{"v1 bad protocol", []byte("PROXY UDP4 1.2.3.4 5.6.7.8 1000 80\r\n"), errors.ErrBadProxyHeader},
+		{"v1 bad IP", []byte("PROXY TCP4 1.2.3 5.6.7.8 1000 80\r\n"), errors.ErrBadProxyHeader},
+		{"v1 IPv6 as TCP4", []byte("PROXY TCP4 ::1 ::2 1000 80\r\n"), errors.ErrBadProxyHeader},
+		{"v1 IPv4 as TCP6", []byte("PROXY TCP6 1.2.3.4 5.6.7.8 1000 80\r\n"), errors.ErrBadProxyHeader},
+		{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 65536\r\n"), errors.ErrBadProxyHeader},
+		{"v2 truncated header", v2Raw(v2CmdProxy, v2FamTCP4, 12, 0)[:14], nil},
+		{"v2 truncated payload", v2Raw(v2CmdProxy, v2FamTCP4, 12, 6), nil},
+		{"v2 oversized", v2Raw(v2CmdProxy, v2FamTCP4, v2MaxLength+1, v2MaxLength+1), errors.ErrBadProxyHeader},
+		{"v2 short addresses", v2Raw(v2CmdProxy, v2FamTCP6, 12, 12), errors.ErrBadProxyHeader},
+		{"v2 bad command", v2Raw(0x22, v2FamTCP4, 12, 12), errors.ErrBadProxyHeader},
+	}
+
+	for _, tt := range tests {
+		_, _, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.header)))
+		if err == nil || (tt.err != nil && err != tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestV2TLVsAndOtherFamilies(t *testing.T) {
+	// TLVs after the addresses are skipped
+	var buf bytes.Buffer
+	WriteHeader(&buf, V2, tcpAddr("1.2.3.4:1000"), tcpAddr("5.6.7.8:80"))
+	header := buf.Bytes()
+	binary.BigEndian.PutUint16(header[14:], 12+5)
+	header = append(header, 0x01, 0x00, 0x02, 'h', '2')
+	header = append(header, "payload"...)
+
+	r := bufio.NewReader(bytes.NewReader(header))
+	src, _, err := ReadHeader(r)
+	if err != nil || src.String() != "1.2.3.4:1000" {
+		t.Fatalf("got %v %v", src, err)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+		t.Errorf("data after header = %q", rest)
+	}
+
+	// UDP and unix sockets are treated as not proxied
+	src, dst, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Raw(v2CmdProxy, 0x12, 12, 12))))
+	if err != nil || src != nil || dst != nil {
+		t.Errorf("UDP: got %v %v %v, want not proxied", src, dst, err)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		WriteHeader(c2, V1, tcpAddr("1.2.3.4:1000"), tcpAddr("5.6.7.8:80"))
+		c2.Write([]byte("hello"))
+		c2.Close()
+	}()
+
+	conn, err := Accept(c1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "1.2.3.4:1000" || conn.LocalAddr().String() != "5.6.7.8:80" {
+		t.Errorf("got addresses %s %s", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	if data, _ := ioutil.ReadAll(conn); string(data) != "hello" {
+		t.Errorf("got data %q", data)
+	}
+}
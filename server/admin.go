@@ -0,0 +1,374 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/logger"
+)
+
+var (
+	adminAddr  = flag.String("adminAddr", "", "serve admin API at http://<adminAddr>/admin/, empty means disabled. natproxys admin also uses it to find the server")
+	adminToken = flag.String("adminToken", "", "bearer token of admin API, empty means no auth, so only listen on a trusted address")
+)
+
+// SessionInfo is a client session on this server
+type SessionInfo struct {
+	ID          int64     `json:"id"`
+	Token       string    `json:"token"` // hash of token
+	Group       string    `json:"group,omitempty"`
+	Client      string    `json:"client"`
+	Version     string    `json:"version,omitempty"`
+	Tunnel      string    `json:"tunnel,omitempty"`
+	HTTP        bool      `json:"http"`
+	Since       time.Time `json:"since"`
+	ActiveConns int64     `json:"active_conns"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+}
+
+// Traffic is the traffic of this server, bytes are counted when connections finish
+type Traffic struct {
+	ActiveConns int64         `json:"active_conns"`
+	BytesIn     int64         `json:"bytes_in"`
+	BytesOut    int64         `json:"bytes_out"`
+	Sessions    []SessionInfo `json:"sessions"`
+}
+
+// KickRequest selects sessions to kick by session id or token, token can also be the hash of token
+type KickRequest struct {
+	ID    int64  `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// TokenRequest creates, updates or rotates a token, or reserves a port for a token
+type TokenRequest struct {
+	Token     string   `json:"token,omitempty"`
+	Port      int      `json:"port,omitempty"`
+	Note      string   `json:"note,omitempty"`
+	ExpiresIn string   `json:"expires_in,omitempty"` // duration such as 720h, or never
+	Scopes    []string `json:"scopes"`               // null means unchanged, [] means full access
+	Grace     string   `json:"grace,omitempty"`      // duration the old token is still valid after rotation
+}
+
+// 解析有效期，空表示不修改，never表示不过期
+func parseTTL(s string) (time.Duration, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "never":
+		return -1, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, errors.ErrBadRequest
+	}
+	return ttl, nil
+}
+
+func (manager *manager) info() SessionInfo {
+	manager.infoMu.Lock()
+	defer manager.infoMu.Unlock()
+
+	return SessionInfo{
+		ID:          manager.id,
+		Token:       logger.TokenHash(manager.token),
+		Group:       manager.group,
+		Client:      manager.clientAddr,
+		Version:     manager.clientVersion,
+		Tunnel:      manager.tunnel,
+		HTTP:        manager.options.http,
+		Since:       manager.since,
+		ActiveConns: atomic.LoadInt64(&manager.activeConns),
+		BytesIn:     atomic.LoadInt64(&manager.bytesIn),
+		BytesOut:    atomic.LoadInt64(&manager.bytesOut),
+	}
+}
+
+func (s *service) sessions() []SessionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(s.managers))
+	for manager := range s.managers {
+		sessions = append(sessions, manager.info())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// 踢掉符合条件的会话，返回踢掉的数量
+func (s *service) kick(req KickRequest, reason error) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for manager := range s.managers {
+		byID := req.ID != 0 && manager.id == req.ID
+		byToken := req.Token != "" && (manager.token == req.Token || logger.TokenHash(manager.token) == req.Token)
+		if byID || byToken {
+			manager.kick(reason)
+			n++
+		}
+	}
+	return n
+}
+
+// 管理接口也接受sessions显示的token hash，吊销等操作要换成真正的token，否则会把hash当成一个新
+// 的token记下来，真正的token仍然有效
+func (s *service) resolveToken(token string) (string, error) {
+	if !strings.HasPrefix(token, "sha256:") {
+		return token, nil
+	}
+
+	var candidates []string
+	s.lock.Lock()
+	for manager := range s.managers {
+		candidates = append(candidates, manager.token)
+	}
+	s.lock.Unlock()
+	for _, entry := range s.tokens.list() {
+		candidates = append(candidates, entry.Token)
+	}
+
+	found := ""
+	for _, candidate := range candidates {
+		if logger.TokenHash(candidate) != token || candidate == found {
+			continue
+		}
+		if found != "" {
+			return "", errors.ErrAmbiguousToken
+		}
+		found = candidate
+	}
+	if found == "" {
+		return "", errors.ErrTokenNotFound
+	}
+	return found, nil
+}
+
+// 重新读取token文件，踢掉已经被吊销的token
+func (s *service) reload() error {
+	if err := s.tokens.reload(); err != nil {
+		return err
+	}
+	for _, entry := range s.tokens.list() {
+		if entry.Revoked {
+			s.kick(KickRequest{Token: entry.Token}, errors.ErrTokenNotValid)
+		}
+	}
+	return nil
+}
+
+func (s *service) serveAdmin() {
+	if *adminAddr == "" {
+		return
+	}
+
+	logger.Info("serve admin API", "addr", *adminAddr)
+	if err := http.ListenAndServe(*adminAddr, http.HandlerFunc(s.serveAdminHTTP)); err != nil {
+		logger.Error("failed to serve admin API", "error", err)
+	}
+}
+
+// 管理API：
+//
+//	GET    /admin/sessions        这台服务器上的会话
+//	GET    /admin/cluster/sessions       整个集群的会话，任意一台服务器都可以回答
+//	GET    /admin/traffic         这台服务器和它的会话的流量
+//	POST   /admin/kick            踢掉会话，请求体为KickRequest
+//	GET    /admin/tokens          管理员管理的token
+//	POST   /admin/tokens          创建token，请求体为TokenRequest
+//	POST   /admin/tokens/<token>         修改过期时间和权限范围，请求体为TokenRequest
+//	POST   /admin/tokens/<token>/rotate  轮换token，请求体为TokenRequest
+//	DELETE /admin/tokens/<token>  吊销token并踢掉它的会话
+//	POST   /admin/ports           为token预留端口，请求体为TokenRequest
+//	DELETE /admin/ports/<port>    取消端口预留
+//	POST   /admin/reload          重新读取token文件
+func (s *service) serveAdminHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := []byte("Bearer " + *adminToken)
+	if *adminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), auth) != 1 {
+		writeAdminError(w, http.StatusUnauthorized, errors.ErrUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/admin")
+	switch {
+	case path == "/sessions" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, s.sessions())
+	case path == "/cluster/sessions" && r.Method == http.MethodGet:
+		sessions, err := s.cluster.List()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, sessions)
+	case path == "/traffic" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, &Traffic{
+			ActiveConns: atomic.LoadInt64(&s.activeConns),
+			BytesIn:     atomic.LoadInt64(&s.bytesIn),
+			BytesOut:    atomic.LoadInt64(&s.bytesOut),
+			Sessions:    s.sessions(),
+		})
+	case path == "/kick" && r.Method == http.MethodPost:
+		var req KickRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ID == 0 && req.Token == "") {
+			writeAdminError(w, http.StatusBadRequest, errors.ErrBadRequest)
+			return
+		}
+		n := s.kick(req, errors.ErrKicked)
+		if n == 0 {
+			writeAdminError(w, http.StatusNotFound, errors.ErrSessionNotFound)
+			return
+		}
+		logger.Info("sessions kicked by admin", "id", req.ID, "token", req.Token, "count", n)
+		writeAdminJSON(w, http.StatusOK, map[string]int{"kicked": n})
+	case path == "/tokens" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, s.tokens.list())
+	case path == "/tokens" && r.Method == http.MethodPost:
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.ErrBadRequest)
+			return
+		}
+		ttl, err := parseTTL(req.ExpiresIn)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		entry, err := s.tokens.create(req.Note, req.Port, ttl, req.Scopes)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		logger.Info("token created by admin", "token", entry.Token, "port", entry.Port)
+		writeAdminJSON(w, http.StatusCreated, entry)
+	case strings.HasPrefix(path, "/tokens/") && strings.HasSuffix(path, "/rotate") && r.Method == http.MethodPost:
+		token, err := s.resolveToken(strings.TrimSuffix(strings.TrimPrefix(path, "/tokens/"), "/rotate"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.ErrBadRequest)
+			return
+		}
+		var grace time.Duration
+		if req.Grace != "" {
+			if grace, err = time.ParseDuration(req.Grace); err != nil {
+				writeAdminError(w, http.StatusBadRequest, errors.ErrBadRequest)
+				return
+			}
+		}
+		entry, err := s.tokens.rotate(token, grace)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		// 没有宽限期时旧token立即失效
+		n := 0
+		if grace <= 0 {
+			n = s.kick(KickRequest{Token: token}, errors.ErrTokenNotValid)
+		} else {
+			s.expireRotated(token)
+		}
+		logger.Info("token rotated by admin", "token", token, "new_token_hash", logger.TokenHash(entry.Token), "grace", grace, "kicked", n)
+		writeAdminJSON(w, http.StatusOK, entry)
+	case strings.HasPrefix(path, "/tokens/") && r.Method == http.MethodPost:
+		token, err := s.resolveToken(strings.TrimPrefix(path, "/tokens/"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.ErrBadRequest)
+			return
+		}
+		ttl, err := parseTTL(req.ExpiresIn)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		entry, err := s.tokens.update(token, ttl, req.Scopes)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		logger.Info("token updated by admin", "token", token, "expires", entry.Expires, "scopes", strings.Join(entry.Scopes, ","))
+		writeAdminJSON(w, http.StatusOK, entry)
+	case strings.HasPrefix(path, "/tokens/") && r.Method == http.MethodDelete:
+		token, err := s.resolveToken(strings.TrimPrefix(path, "/tokens/"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		if err := s.tokens.revoke(token); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		n := s.kick(KickRequest{Token: token}, errors.ErrTokenNotValid)
+		logger.Info("token revoked by admin", "token", token, "kicked", n)
+		writeAdminJSON(w, http.StatusOK, map[string]int{"kicked": n})
+	case path == "/ports" && r.Method == http.MethodPost:
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			writeAdminError(w, http.StatusBadRequest, errors.ErrBadRequest)
+			return
+		}
+		token, err := s.resolveToken(req.Token)
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		if err := s.tokens.reserve(token, req.Port); err != nil {
+			writeAdminError(w, http.StatusConflict, err)
+			return
+		}
+		logger.Info("port reserved by admin", "token", token, "port", req.Port)
+		writeAdminJSON(w, http.StatusOK, s.tokens.get(token))
+	case strings.HasPrefix(path, "/ports/") && r.Method == http.MethodDelete:
+		port, err := strconv.Atoi(strings.TrimPrefix(path, "/ports/"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.ErrBadRequest)
+			return
+		}
+		if err := s.tokens.release(port); err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		logger.Info("port released by admin", "port", port)
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/reload" && r.Method == http.MethodPost:
+		if err := s.reload(); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		logger.Info("token file reloaded by admin")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/cluster"
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+const adminTimeout = time.Second * 10
+
+var adminClient = &http.Client{Timeout: adminTimeout}
+
+// 调用-adminAddr上的管理接口
+func admin(method, path string, body, result interface{}) error {
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://"+*adminAddr+"/admin"+path, &reader)
+	if err != nil {
+		return err
+	}
+	if *adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+	}
+	resp, err := adminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.ErrBadRequest
+		}
+		return fmt.Errorf("admin API error: %s", e.Error)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// AdminSessions lists sessions of the server at -adminAddr
+func AdminSessions() ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	err := admin(http.MethodGet, "/sessions", nil, &sessions)
+	return sessions, err
+}
+
+// AdminClusterSessions returns sessions of the whole cluster
+func AdminClusterSessions() ([]cluster.Session, error) {
+	var sessions []cluster.Session
+	err := admin(http.MethodGet, "/cluster/sessions", nil, &sessions)
+	return sessions, err
+}
+
+// AdminTraffic returns traffic of the server at -adminAddr
+func AdminTraffic() (*Traffic, error) {
+	traffic := &Traffic{}
+	err := admin(http.MethodGet, "/traffic", nil, traffic)
+	return traffic, err
+}
+
+// AdminKick kicks sessions and returns how many sessions are kicked
+func AdminKick(req KickRequest) (int, error) {
+	var result struct {
+		Kicked int `json:"kicked"`
+	}
+	err := admin(http.MethodPost, "/kick", req, &result)
+	return result.Kicked, err
+}
+
+// AdminTokens lists tokens managed by admin
+func AdminTokens() ([]TokenEntry, error) {
+	var tokens []TokenEntry
+	err := admin(http.MethodGet, "/tokens", nil, &tokens)
+	return tokens, err
+}
+
+// AdminCreateToken creates a token which is valid on the server without the registry
+func AdminCreateToken(req *TokenRequest) (*TokenEntry, error) {
+	entry := &TokenEntry{}
+	err := admin(http.MethodPost, "/tokens", req, entry)
+	return entry, err
+}
+
+// AdminUpdateToken updates expiry and scopes of a token
+func AdminUpdateToken(token string, req *TokenRequest) (*TokenEntry, error) {
+	entry := &TokenEntry{}
+	err := admin(http.MethodPost, "/tokens/"+url.PathEscape(token), req, entry)
+	return entry, err
+}
+
+// AdminRotateToken replaces a token with a new one which keeps its reserved port and scopes
+func AdminRotateToken(token string, grace string) (*TokenEntry, error) {
+	entry := &TokenEntry{}
+	err := admin(http.MethodPost, "/tokens/"+url.PathEscape(token)+"/rotate", &TokenRequest{Grace: grace}, entry)
+	return entry, err
+}
+
+// AdminRevokeToken revokes a token and returns how many sessions are kicked
+func AdminRevokeToken(token string) (int, error) {
+	var result struct {
+		Kicked int `json:"kicked"`
+	}
+	err := admin(http.MethodDelete, "/tokens/"+url.PathEscape(token), nil, &result)
+	return result.Kicked, err
+}
+
+// AdminReservePort reserves a WAN port for a token
+func AdminReservePort(token string, port int) (*TokenEntry, error) {
+	entry := &TokenEntry{}
+	err := admin(http.MethodPost, "/ports", &TokenRequest{Token: token, Port: port}, entry)
+	return entry, err
+}
+
+// AdminReleasePort releases a reserved port
+func AdminReleasePort(port int) error {
+	return admin(http.MethodDelete, "/ports/"+strconv.Itoa(port), nil, nil)
+}
+
+// AdminReload reloads the token file
+func AdminReload() error {
+	return admin(http.MethodPost, "/reload", nil, nil)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/pb"
+)
+
+type codeInfo struct {
+	code      pb.ErrorCode
+	retryable bool
+}
+
+// 发给客户端的错误码，没有列出的错误都是可以重试的未知错误
+var codes = map[error]codeInfo{
+	errors.ErrTokenNotValid:        {pb.ErrorCode_TokenNotValid, false},
+	errors.ErrFailedToAllocatePort: {pb.ErrorCode_FailedToAllocatePort, true},
+	errors.ErrFailedToListen:       {pb.ErrorCode_FailedToAllocatePort, true},
+	errors.ErrRotatedTokenOnline:   {pb.ErrorCode_FailedToAllocatePort, true},
+	errors.ErrFailedToRegisterAddr: {pb.ErrorCode_FailedToRegisterAddr, true},
+	errors.ErrRegistryUnavailable:  {pb.ErrorCode_RegistryUnavailable, true},
+	errors.ErrServerShuttingDown:   {pb.ErrorCode_ServerShuttingDown, true},
+	errors.ErrClientTooOld:         {pb.ErrorCode_ClientTooOld, false},
+	errors.ErrSessionTaken:         {pb.ErrorCode_SessionTaken, true},
+	errors.ErrBadMetadata:          {pb.ErrorCode_BadMetadata, false},
+	errors.ErrBadRequest:           {pb.ErrorCode_BadRequest, false},
+	errors.ErrNotSupport:           {pb.ErrorCode_NotSupport, false},
+	errors.ErrTokenExpired:         {pb.ErrorCode_TokenExpired, false},
+	errors.ErrPermissionDenied:     {pb.ErrorCode_PermissionDenied, false},
+	errors.ErrGroupMismatch:        {pb.ErrorCode_BadMetadata, false},
+}
+
+// 发给客户端的错误信息
+func errorInfo(err error) *pb.ErrorInfo {
+	info, ok := codes[err]
+	if !ok {
+		info = codeInfo{pb.ErrorCode_UnknownError, true}
+	}
+
+	return &pb.ErrorInfo{Message: err.Error(), Code: info.code, Retryable: info.retryable}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/ipfilter"
+)
+
+// 同一个token下加入同名分组的客户端共享一个公网监听，公网连接轮流分给组内的客户端，
+// 某个客户端断开之后，新连接和还没配对完成的连接自动交给组内其他客户端
+type tunnelGroup struct {
+	key         string
+	rateLimiter *rateLimiter     // 整个分组的接受速率限制
+	filter      *ipfilter.Filter // 整个分组的公网连接IP过滤
+	filterRules string
+
+	// 第一个加入的客户端在锁外创建公网监听，完成后关闭ready，其他客户端等待ready
+	ready    chan struct{}
+	listener net.Listener
+	addr     string
+	err      error
+
+	lock    sync.Mutex
+	members []*manager
+	next    int
+}
+
+// 加入分组，第一个加入的客户端负责创建公网监听
+func (s *service) joinGroup(ctx context.Context, manager *manager, name string) (*tunnelGroup, error) {
+	key := manager.token + "/" + name
+
+	s.groupLock.Lock()
+	group, ok := s.groups[key]
+	if !ok {
+		group = &tunnelGroup{
+			key:         key,
+			rateLimiter: newRateLimiter(*wanRatePerTunnel, *wanBurstPerTunnel),
+			filter:      manager.options.filter,
+			filterRules: manager.options.filterRules,
+			ready:       make(chan struct{}),
+		}
+		s.groups[key] = group
+	}
+	if group.filterRules != manager.options.filterRules {
+		s.groupLock.Unlock()
+		return nil, errors.ErrGroupMismatch
+	}
+	manager.tunnelGroup, manager.rateLimiter = group, group.rateLimiter
+	group.lock.Lock()
+	group.members = append(group.members, manager)
+	group.lock.Unlock()
+	s.groupLock.Unlock()
+
+	// 访问注册中心和监听端口都可能很慢，不能持有全局锁。分组使用token默认的公网地址
+	if !ok {
+		group.listener, group.addr, group.err = s.getWANListen(ctx, manager.token, "")
+		if group.err == nil {
+			go group.serve()
+		} else {
+			// 后来的客户端重新创建分组，不要再等这个失败的分组
+			s.groupLock.Lock()
+			if s.groups[key] == group {
+				delete(s.groups, key)
+			}
+			s.groupLock.Unlock()
+		}
+		close(group.ready)
+	}
+
+	select {
+	case <-group.ready:
+	case <-ctx.Done():
+		s.leaveGroup(group, manager)
+		return nil, errors.ErrCanceled
+	}
+	if group.err != nil {
+		s.leaveGroup(group, manager)
+		return nil, group.err
+	}
+
+	return group, nil
+}
+
+// 离开分组，还没处理的公网连接交给组内其他客户端，最后一个客户端离开时关闭公网监听
+func (s *service) leaveGroup(group *tunnelGroup, manager *manager) {
+	s.groupLock.Lock()
+	defer s.groupLock.Unlock()
+
+	group.lock.Lock()
+	for i, member := range group.members {
+		if member == manager {
+			group.members = append(group.members[:i], group.members[i+1:]...)
+			break
+		}
+	}
+	for pending := true; pending; {
+		select {
+		case conn := <-manager.wanConnCh:
+			group.handover(conn)
+		default:
+			pending = false
+		}
+	}
+	close(manager.wanConnCh)
+	empty := len(group.members) == 0
+	group.lock.Unlock()
+
+	if empty {
+		// 创建监听失败之后可能已经有新的同名分组了
+		if s.groups[group.key] == group {
+			delete(s.groups, group.key)
+		}
+		if group.listener != nil {
+			group.listener.Close()
+		}
+	}
+}
+
+// 轮流选择组内客户端，调用时需要持有group.lock
+func (group *tunnelGroup) pick() *manager {
+	if len(group.members) == 0 {
+		return nil
+	}
+
+	group.next = (group.next + 1) % len(group.members)
+	return group.members[group.next]
+}
+
+// 把离开的客户端还没处理的公网连接交给其他客户端，调用时需要持有group.lock
+func (group *tunnelGroup) handover(conn net.Conn) {
+	if member := group.pick(); member != nil {
+		select {
+		case member.wanConnCh <- conn:
+			return
+		default:
+			metrics.Add(metricWANConnsOverflow, 1)
+		}
+	}
+	conn.Close()
+}
+
+// 会话结束时正在等待配对的公网连接，交给组内其他客户端重新处理。还在组内说明是会话结束时
+// 没来得及离开分组，这时不能再交给它自己
+func (group *tunnelGroup) takeover(from *manager, conn net.Conn) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	for range group.members {
+		if member := group.pick(); member != from {
+			select {
+			case member.wanConnCh <- conn:
+			default:
+				metrics.Add(metricWANConnsOverflow, 1)
+				conn.Close()
+			}
+			return
+		}
+	}
+	conn.Close()
+}
+
+// 接收公网连接并分给组内的客户端
+func (group *tunnelGroup) serve() {
+	for {
+		conn, err := group.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		group.lock.Lock()
+		if member := group.pick(); member != nil {
+			member.dispatchWANConn(conn)
+		} else {
+			conn.Close()
+		}
+		group.lock.Unlock()
+	}
+}
@@ -0,0 +1,167 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/logger"
+)
+
+// 父进程通过这个环境变量告诉子进程继承下来的监听器，格式为 "control,15001,15002"，
+// 第i个名字对应文件描述符 3+i
+const inheritedFDsEnv = "NATPROXY_INHERITED_FDS"
+
+const controlListenerName = "control"
+
+// 有名字的隧道使用的端口也交给子进程，隧道重连之后还使用原来的公网地址，JSON格式
+const tunnelPortsEnv = "NATPROXY_TUNNEL_PORTS"
+
+// 收到SIGUSR2时进行热升级
+func notifyUpgrade(sigCh chan<- os.Signal) {
+	signal.Notify(sigCh, syscall.SIGUSR2)
+}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// 通知systemd服务的状态，不是由systemd启动时什么也不做
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		logger.Warn("failed to notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Warn("failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// 从父进程继承监听器，返回控制端口的监听器(可能为nil)以及按端口索引的公网监听器
+func inheritListeners() (net.Listener, map[string]net.Listener) {
+	names := os.Getenv(inheritedFDsEnv)
+	os.Unsetenv(inheritedFDsEnv)
+
+	wanListeners := make(map[string]net.Listener)
+	if names == "" {
+		return nil, wanListeners
+	}
+
+	var control net.Listener
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			logger.Error("failed to inherit listener", "name", name, "error", err)
+			continue
+		}
+
+		if name == controlListenerName {
+			control = l
+		} else {
+			wanListeners[name] = l
+		}
+		logger.Info("inherited listener", "name", name, "addr", l.Addr())
+	}
+
+	return control, wanListeners
+}
+
+// 从父进程继承有名字的隧道使用的端口
+func inheritTunnelPorts() map[string]string {
+	value := os.Getenv(tunnelPortsEnv)
+	os.Unsetenv(tunnelPortsEnv)
+
+	ports := make(map[string]string)
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &ports); err != nil {
+			logger.Error("failed to inherit tunnel ports", "error", err)
+		}
+	}
+	return ports
+}
+
+// 启动新的进程，并把控制端口以及所有公网端口的监听器交给它
+func (s *service) handoff(control net.Listener) error {
+	listeners := map[string]net.Listener{controlListenerName: control}
+
+	s.lock.Lock()
+	for manager := range s.managers {
+		manager.listenerMu.Lock()
+		if manager.wanListener != nil {
+			listeners[listenerPort(manager.wanListener)] = manager.wanListener
+		}
+		manager.listenerMu.Unlock()
+	}
+	for port, l := range s.inherited {
+		listeners[port] = l
+	}
+	tunnelPorts, err := json.Marshal(s.tunnelPorts)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for name, l := range listeners {
+		tcpListener, ok := l.(*net.TCPListener)
+		if !ok {
+			return errors.ErrNotSupport
+		}
+		// 会话刚结束时监听器已经关闭，不用交给新进程
+		f, err := tcpListener.File()
+		if err != nil {
+			if name == controlListenerName {
+				return err
+			}
+			logger.Warn("skip listener which can't be handed off", "name", name, "error", err)
+			continue
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), fmt.Sprintf("%s=%s", inheritedFDsEnv, strings.Join(names, ",")), fmt.Sprintf("%s=%s", tunnelPortsEnv, tunnelPorts))
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("started new process", "pid", process.Pid, "listeners", len(files))
+
+	// 新进程启动之后再交出集群存储，有的存储不能被两个进程同时打开，新进程会等一会。之后旧进程的会话不再写入集群存储
+	if err := s.cluster.Handoff(); err != nil {
+		logger.Warn("failed to hand off cluster store", "error", err)
+	}
+	// systemd的Type=notify服务改为跟踪新进程，旧进程退出后不会被当作服务停止
+	sdNotify(fmt.Sprintf("MAINPID=%d", process.Pid))
+	return nil
+}
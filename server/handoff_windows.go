@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"os"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+func notifyUpgrade(sigCh chan<- os.Signal) {}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return false
+}
+
+func inheritListeners() (net.Listener, map[string]net.Listener) {
+	return nil, make(map[string]net.Listener)
+}
+
+func inheritTunnelPorts() map[string]string {
+	return make(map[string]string)
+}
+
+func sdNotify(state string) {}
+
+func (s *service) handoff(control net.Listener) error {
+	return errors.ErrNotSupport
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/dial"
+)
+
+// 检查请求是否带有隧道要求的认证信息
+func (o tunnelOptions) authorize(req *http.Request) bool {
+	if o.basicAuth == "" && o.bearer == "" {
+		return true
+	}
+
+	if o.basicAuth != "" {
+		user, password, ok := req.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(o.basicAuth)) == 1 {
+			return true
+		}
+	}
+
+	auth := req.Header.Get("Authorization")
+	if o.bearer != "" && strings.HasPrefix(auth, "Bearer ") {
+		if subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(o.bearer)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 添加X-Forwarded-*头部，按需改写Host
+func (o tunnelOptions) rewriteRequest(req *http.Request, wanConn net.Conn) {
+	// 认证信息是给隧道用的，不要传给本地服务
+	if o.basicAuth != "" || o.bearer != "" {
+		req.Header.Del("Authorization")
+	}
+
+	if ip, _, err := net.SplitHostPort(wanConn.RemoteAddr().String()); err == nil {
+		if prior := req.Header["X-Forwarded-For"]; len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	// 服务器是最外层，公网来的值不可信
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("X-Forwarded-Host", req.Host)
+
+	if o.httpHost != "" {
+		req.Host = o.httpHost
+	}
+
+	// 不要让req.Write添加默认的User-Agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+func writeHTTPError(w io.Writer, req *http.Request, code int) error {
+	body := fmt.Sprintf("%d %s\n", code, http.StatusText(code))
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if code == http.StatusUnauthorized {
+		resp.Header.Set("WWW-Authenticate", `Basic realm="natproxy"`)
+	}
+
+	return resp.Write(w)
+}
+
+// 解析公网来的HTTP请求，认证通过之后再通知客户端建立连接并转发
+func (manager *manager) proxyHTTP(wanConn net.Conn, clientListenerAddr string) (dial.Stats, error) {
+	wan := &dial.CountConn{Conn: wanConn}
+	wanReader := bufio.NewReader(wan)
+	defer wanConn.Close()
+
+	var stats dial.Stats
+	var clientConn net.Conn
+	var clientReader *bufio.Reader
+	defer func() {
+		if clientConn != nil {
+			clientConn.Close()
+		}
+	}()
+
+	for {
+		// 请求头读完之后不再限制，请求体跟着转发
+		if *httpHeaderTimeout > 0 {
+			wanConn.SetReadDeadline(time.Now().Add(*httpHeaderTimeout))
+		}
+		req, err := http.ReadRequest(wanReader)
+		wanConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			stats.Closer = wanConn
+			if err != io.EOF {
+				stats.Err = err
+			}
+			break
+		}
+
+		if !manager.options.authorize(req) {
+			io.Copy(ioutil.Discard, req.Body)
+			req.Body.Close()
+			if err := writeHTTPError(wan, req, http.StatusUnauthorized); err != nil || req.Close {
+				stats.Closer, stats.Err = wanConn, err
+				break
+			}
+			continue
+		}
+
+		if clientConn == nil {
+			clientConn, err = manager.connectClient(wanConn, clientListenerAddr)
+			if err != nil {
+				writeHTTPError(wan, req, http.StatusBadGateway)
+				return stats, err
+			}
+			clientReader = bufio.NewReader(clientConn)
+		}
+
+		manager.options.rewriteRequest(req, wanConn)
+		if err := req.Write(clientConn); err != nil {
+			stats.Closer, stats.Err = clientConn, err
+			break
+		}
+		resp, err := http.ReadResponse(clientReader, req)
+		if err != nil {
+			writeHTTPError(wan, req, http.StatusBadGateway)
+			stats.Closer, stats.Err = clientConn, err
+			break
+		}
+		err = resp.Write(wan)
+		resp.Body.Close()
+		if err != nil {
+			stats.Closer, stats.Err = wanConn, err
+			break
+		}
+
+		// websocket等协议升级之后直接转发
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			c1 := &dial.BufferedConn{Conn: wan, Reader: wanReader}
+			c2 := &dial.BufferedConn{Conn: clientConn, Reader: clientReader}
+			joined := dial.JoinWith(c1, c2, manager.service.join)
+			stats.Closer, stats.Err = wanConn, joined.Err
+			if joined.Closer == c2 {
+				stats.Closer = clientConn
+			}
+			break
+		}
+
+		if resp.Close {
+			stats.Closer = clientConn
+			break
+		}
+		if req.Close {
+			stats.Closer = wanConn
+			break
+		}
+	}
+
+	stats.InCount, stats.OutCount = wan.WriteCount, wan.ReadCount
+	return stats, nil
+}
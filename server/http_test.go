@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// 公网来的X-Forwarded-Proto被覆盖，X-Forwarded-For追加
+func TestRewriteRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Authorization", "Bearer secret")
+	wanConn := addrConn{remote: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}}
+
+	tunnelOptions{bearer: "secret", httpHost: "localhost:8080"}.rewriteRequest(req, wanConn)
+
+	want := map[string]string{
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-For":   "10.0.0.1, 1.2.3.4",
+		"X-Forwarded-Host":  "example.com",
+		"Authorization":     "",
+	}
+	for key, value := range want {
+		if got := req.Header.Get(key); got != value {
+			t.Errorf("%s: got %q, want %q", key, got, value)
+		}
+	}
+	if req.Host != "localhost:8080" {
+		t.Errorf("host: got %q", req.Host)
+	}
+}
@@ -1,43 +1,155 @@
 package server
 
 import (
-	"log"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/jiajunhuang/natproxy/accesslog"
+	"github.com/jiajunhuang/natproxy/compression"
 	"github.com/jiajunhuang/natproxy/dial"
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/logger"
 	"github.com/jiajunhuang/natproxy/pb"
+	"github.com/jiajunhuang/natproxy/protocol"
+	"github.com/jiajunhuang/natproxy/proxyproto"
 	"google.golang.org/grpc/peer"
 )
 
+const (
+	proxyHeaderTimeout = time.Second * 10
+	connIDTimeout      = time.Second * 10
+)
+
 type manager struct {
 	service      *service
-	wanConnCh    chan net.Conn        // connections from WAN
-	clientConnCh chan net.Conn        // connections from client
-	msgCh        chan *pb.MsgResponse // messages send to client
-	clientMsgCh  chan *pb.MsgRequest  // messages from client
+	log          *logger.Logger
+	id           int64 // 这台服务器上的会话编号
+	token        string
+	tunnel       string // 这个会话的公网地址
+	group        string
+	clientAddr   string
+	since        time.Time
+	wanConnCh    chan net.Conn        // 公网连接
+	clientConnCh chan net.Conn        // 客户端连接
+	msgCh        chan *pb.MsgResponse // 发给客户端的消息
+	clientMsgCh  chan *pb.MsgRequest  // 客户端发来的消息
+
+	wanListener net.Listener
+	listenerMu  sync.Mutex
+	drainCh     chan struct{} // 服务器开始退出时关闭
+	drainOnce   sync.Once
+	stopCh      chan struct{} // 会话需要结束时关闭
+	stopOnce    sync.Once
+	stopErr     error // 会话被踢下线时发给客户端的原因
+
+	protocolVersion uint32
+	features        []string // 双方都支持的特性
+	typedMsgs       bool     // 客户端支持带类型的消息，否则发送旧格式的消息
+
+	options     tunnelOptions
+	rateLimiter *rateLimiter // 这个隧道的接受速率限制
+	tunnelGroup *tunnelGroup // 隧道不在分组里时为nil
+
+	pendingWANConns int64 // 等待客户端连接的公网连接数
+	headerWANConns  int64 // 等待PROXY protocol头的公网连接数
+	pairByID        bool  // 客户端会回传连接编号，可以准确配对
+	dataTLS         bool  // 客户端连接使用TLS加密
+	pendingMu       sync.Mutex
+	pending         map[uint64]chan net.Conn // 等待客户端连接的公网连接，按编号索引
+	pendingDone     bool
+
+	infoMu        sync.Mutex
+	clientVersion string // 客户端上报的版本
+	activeConns   int64  // 正在转发的连接数
+	bytesIn       int64  // 已结束的连接从公网收到的字节数
+	bytesOut      int64  // 已结束的连接发往公网的字节数
 }
 
 func newManager(svc *service, bufSize int) *manager {
 	return &manager{
 		service:      svc,
+		log:          logger.With(),
 		wanConnCh:    make(chan net.Conn, bufSize),
 		clientConnCh: make(chan net.Conn, bufSize),
 		msgCh:        make(chan *pb.MsgResponse, bufSize),
 		clientMsgCh:  make(chan *pb.MsgRequest, bufSize),
+		drainCh:      make(chan struct{}),
+		stopCh:       make(chan struct{}),
+		pending:      make(map[uint64]chan net.Conn),
+	}
+}
+
+func (manager *manager) setWANListener(l net.Listener) {
+	manager.listenerMu.Lock()
+	defer manager.listenerMu.Unlock()
+
+	manager.wanListener = l
+}
+
+// 关闭公网监听，不再接受新的公网连接
+func (manager *manager) closeWANListener() {
+	manager.listenerMu.Lock()
+	defer manager.listenerMu.Unlock()
+
+	if manager.wanListener != nil {
+		manager.wanListener.Close()
+	}
+}
+
+// 通知会话进入退出流程
+func (manager *manager) drain() {
+	manager.drainOnce.Do(func() { close(manager.drainCh) })
+}
+
+// 结束会话
+func (manager *manager) stop() {
+	manager.stopOnce.Do(func() { close(manager.stopCh) })
+}
+
+// 管理员踢掉会话，err是告诉客户端的原因
+func (manager *manager) kick(err error) {
+	manager.stopOnce.Do(func() {
+		manager.stopErr = err
+		close(manager.stopCh)
+	})
+}
+
+// 发送消息给客户端，旧版本客户端只认识旧的消息格式
+func (manager *manager) send(stream pb.ServerService_MsgServer, msg *pb.MsgResponse) error {
+	if !manager.typedMsgs {
+		legacy, err := msg.Legacy()
+		if err != nil {
+			return err
+		}
+		msg = legacy
 	}
+
+	return stream.Send(msg)
 }
 
-// 客户端消息接收器
-func (manager *manager) receiveMsgFromClient(stream pb.ServerService_MsgServer) {
+// 客户端消息接收器，first是握手时已经读到的消息
+func (manager *manager) receiveMsgFromClient(stream pb.ServerService_MsgServer, first *pb.MsgRequest) {
 	defer close(manager.clientMsgCh)
 
+	if first != nil {
+		manager.clientMsgCh <- first
+	}
 	for {
 		req, err := stream.Recv()
 		if err != nil {
 			return
 		}
 
-		manager.clientMsgCh <- req
+		select {
+		case manager.clientMsgCh <- req:
+		case <-manager.stopCh:
+			return
+		}
 	}
 }
 
@@ -50,48 +162,335 @@ func (manager *manager) handleConnFromWAN(clientListenerAddr string) {
 		}
 
 		go func() {
-			// 下发消息给客户端要求建立新的connection
-			manager.msgCh <- &pb.MsgResponse{Type: pb.MsgType_Connect, Data: []byte(clientListenerAddr)}
+			start := time.Now()
+
+			// 服务器在负载均衡后面时，从PROXY protocol头部获取真实地址。组内其他客户端转交过来的连接已经读过头部
+			if _, ok := wanConn.(*proxyproto.Conn); *wanProxyProtocol && !ok {
+				atomic.AddInt64(&manager.headerWANConns, 1)
+				conn, err := proxyproto.Accept(wanConn, proxyHeaderTimeout)
+				atomic.AddInt64(&manager.headerWANConns, -1)
+				if err != nil {
+					manager.log.Warn("failed to read PROXY protocol header", "wan", wanConn.RemoteAddr(), "error", err)
+					wanConn.Close()
+					return
+				}
+				wanConn = conn
 
-			// 等待新的connection
-			clientConn, ok := <-manager.clientConnCh
-			if !ok {
-				log.Printf("failed to receive connection from client connection channel")
+				if !manager.admitWANSource(wanConn) {
+					wanConn.Close()
+					return
+				}
+			}
+
+			atomic.AddInt64(&manager.service.activeConns, 1)
+			defer atomic.AddInt64(&manager.service.activeConns, -1)
+			atomic.AddInt64(&manager.activeConns, 1)
+			defer atomic.AddInt64(&manager.activeConns, -1)
+
+			var stats dial.Stats
+			var err error
+			if manager.options.http {
+				stats, err = manager.proxyHTTP(wanConn, clientListenerAddr)
+			} else {
+				stats, err = manager.proxyTCP(wanConn, clientListenerAddr)
+			}
+			if err == errors.ErrTooManyPendingConns {
+				manager.log.Debug("too many pending WAN connections", "wan", wanConn.RemoteAddr())
+				return
+			}
+			if err != nil {
+				manager.log.Warn("failed to proxy connection from WAN", "wan", wanConn.RemoteAddr(), "error", err)
 				return
 			}
-			wanConnAddr, clientConnAddr := wanConn.LocalAddr(), clientConn.RemoteAddr()
-			defer log.Printf("connection between WAN(%s) & client(%s) disconnected", wanConnAddr, clientConnAddr)
 
-			// 把两个connection串起来
-			dial.Join(wanConn, clientConn)
+			manager.countTraffic(stats)
+			manager.writeAccessLog(wanConn, start, stats)
 		}()
 	}
 }
 
+// 功能是否双方都支持，旧版本客户端没有握手，什么功能都不支持
+func (manager *manager) has(feature string) bool {
+	return protocol.Has(manager.features, feature)
+}
+
+// 通知客户端建立新连接，并等待新连接到来
+func (manager *manager) connectClient(wanConn net.Conn, clientListenerAddr string) (net.Conn, error) {
+	if atomic.AddInt64(&manager.pendingWANConns, 1) > int64(*maxPendingWANConns) {
+		atomic.AddInt64(&manager.pendingWANConns, -1)
+		metrics.Add(metricWANConnsOverflow, 1)
+		return nil, errors.ErrTooManyPendingConns
+	}
+	defer atomic.AddInt64(&manager.pendingWANConns, -1)
+
+	// 下发消息给客户端要求建立新的connection
+	connect := &pb.ConnectRequest{
+		Addr:    clientListenerAddr,
+		SrcAddr: wanConn.RemoteAddr().String(),
+		DstAddr: wanConn.LocalAddr().String(),
+	}
+	var clientConnCh <-chan net.Conn = manager.clientConnCh
+	if manager.pairByID {
+		var err error
+		connect.ConnId, clientConnCh, err = manager.addPending()
+		if err != nil {
+			return nil, err
+		}
+		defer manager.removePending(connect.ConnId)
+	}
+	msg := &pb.MsgResponse{Type: pb.MsgType_Connect, Payload: &pb.MsgResponse_Connect{Connect: connect}}
+	select {
+	case manager.msgCh <- msg:
+	case <-manager.stopCh:
+		return nil, errors.ErrSessionClosed
+	}
+
+	// 等待新的connection
+	clientConn, ok := <-clientConnCh
+	if !ok {
+		return nil, errors.ErrConnectionChClosed
+	}
+
+	conn, err := compression.Wrap(clientConn, manager.options.compression)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// 直接把公网连接和客户端连接串起来
+func (manager *manager) proxyTCP(wanConn net.Conn, clientListenerAddr string) (dial.Stats, error) {
+	clientConn, err := manager.connectClient(wanConn, clientListenerAddr)
+	if (err == errors.ErrSessionClosed || err == errors.ErrConnectionChClosed) && manager.tunnelGroup != nil {
+		// 会话结束了但公网连接还没有数据交换，交给组内其他客户端。HTTP隧道已经读走了请求，不能转交
+		manager.tunnelGroup.takeover(manager, wanConn)
+		return dial.Stats{}, err
+	}
+	if err != nil {
+		wanConn.Close()
+		return dial.Stats{}, err
+	}
+	wanConnAddr, clientConnAddr := wanConn.LocalAddr(), clientConn.RemoteAddr()
+	defer manager.log.Info("connection between WAN & client disconnected", "wan", wanConnAddr, "client_conn", clientConnAddr)
+
+	return dial.JoinWith(wanConn, clientConn, manager.service.join), nil
+}
+
+// 统计流量，连接结束时才计入
+func (manager *manager) countTraffic(stats dial.Stats) {
+	atomic.AddInt64(&manager.bytesIn, stats.OutCount)
+	atomic.AddInt64(&manager.bytesOut, stats.InCount)
+	atomic.AddInt64(&manager.service.bytesIn, stats.OutCount)
+	atomic.AddInt64(&manager.service.bytesOut, stats.InCount)
+}
+
+func (manager *manager) writeAccessLog(wanConn net.Conn, start time.Time, stats dial.Stats) {
+	reason := "client closed"
+	if stats.Closer == wanConn {
+		reason = "WAN closed"
+	}
+	if stats.Err != nil {
+		reason = stats.Err.Error()
+	}
+
+	err := manager.service.accessLog.Write(&accesslog.Entry{
+		Source:     wanConn.RemoteAddr().String(),
+		Tunnel:     manager.tunnel,
+		Token:      logger.TokenHash(manager.token),
+		Start:      start,
+		DurationMS: int64(time.Since(start) / time.Millisecond),
+		BytesIn:    stats.OutCount,
+		BytesOut:   stats.InCount,
+		Reason:     reason,
+	})
+	if err != nil {
+		manager.log.Warn("failed to write access log", "error", err)
+	}
+}
+
 // 接收来自客户端的请求并且传递给channel
 func (manager *manager) receiveConnFromClient(client *peer.Peer, clientListener net.Listener) {
 	defer close(manager.clientConnCh)
 
-	log.Printf("start to wait new connections from client...")
+	defer manager.closePending()
+
+	manager.log.Debug("start to wait new connections from client")
 	for {
 		conn, err := clientListener.Accept()
 		if err != nil {
 			return
 		}
-		manager.clientConnCh <- conn
+		conn = manager.service.dataSocket.Apply(conn)
+		if manager.dataTLS {
+			conn = tls.Server(conn, manager.service.tlsConfig)
+		}
+
+		if manager.pairByID {
+			go manager.pairClientConn(conn)
+		} else {
+			manager.clientConnCh <- conn
+		}
+	}
+}
+
+// 随机的连接编号，能连上客户端监听的人也猜不到正在等待的编号，0表示没有编号
+func newConnID() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id, nil
+		}
 	}
 }
 
+// 登记一个等待客户端连接的公网连接
+func (manager *manager) addPending() (uint64, <-chan net.Conn, error) {
+	manager.pendingMu.Lock()
+	defer manager.pendingMu.Unlock()
+
+	ch := make(chan net.Conn, 1)
+	if manager.pendingDone {
+		close(ch)
+		return 0, ch, nil
+	}
+
+	for {
+		id, err := newConnID()
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, ok := manager.pending[id]; !ok {
+			manager.pending[id] = ch
+			return id, ch, nil
+		}
+	}
+}
+
+func (manager *manager) removePending(id uint64) {
+	manager.pendingMu.Lock()
+	defer manager.pendingMu.Unlock()
+
+	delete(manager.pending, id)
+}
+
+// 客户端监听关闭之后，不会再有新连接了
+func (manager *manager) closePending() {
+	manager.pendingMu.Lock()
+	defer manager.pendingMu.Unlock()
+
+	manager.pendingDone = true
+	for id, ch := range manager.pending {
+		close(ch)
+		delete(manager.pending, id)
+	}
+}
+
+// 读取客户端在新连接开头发送的连接编号，交给对应的公网连接
+func (manager *manager) pairClientConn(conn net.Conn) {
+	var id uint64
+	conn.SetReadDeadline(time.Now().Add(connIDTimeout))
+	if err := binary.Read(conn, binary.BigEndian, &id); err != nil {
+		manager.log.Warn("failed to read connection id", "client_conn", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	manager.pendingMu.Lock()
+	ch, ok := manager.pending[id]
+	delete(manager.pending, id)
+	manager.pendingMu.Unlock()
+
+	// 编号不对时直接关闭，不告诉对方任何信息
+	if !ok {
+		manager.log.Debug("no WAN connection waiting for this id", "client_conn", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	ch <- conn
+}
+
 // 接收来自公网的请求并且传递给channel
 func (manager *manager) receiveConnFromWAN(client *peer.Peer, wanListener net.Listener) {
 	defer close(manager.wanConnCh)
 
-	log.Printf("start to wait new connections from WAN...")
+	manager.log.Debug("start to wait new connections from WAN")
 	for {
 		conn, err := wanListener.Accept()
 		if err != nil {
 			return
 		}
-		manager.wanConnCh <- conn
+
+		manager.dispatchWANConn(conn)
+	}
+}
+
+// 检查公网连接并交给处理器
+func (manager *manager) dispatchWANConn(conn net.Conn) {
+	// 使用PROXY protocol时，要读取头部之后才知道真实来源，但是隧道限速和等待数量限制要在读取头部之前检查，
+	// 否则大量连接都会等待头部
+	if (!*wanProxyProtocol && !manager.admitWANSource(conn)) || !manager.admitWANListener(conn) {
+		conn.Close()
+		return
+	}
+
+	conn = manager.service.wanSocket.Apply(conn)
+
+	// 不要阻塞在channel上，处理不过来的连接直接关闭
+	select {
+	case manager.wanConnCh <- conn:
+	default:
+		metrics.Add(metricWANConnsOverflow, 1)
+		conn.Close()
 	}
 }
+
+// 检查公网连接的来源：IP是否被允许，是否超过单个IP的限速
+func (manager *manager) admitWANSource(conn net.Conn) bool {
+	addr := conn.RemoteAddr()
+	filter := manager.options.filter
+	if manager.tunnelGroup != nil {
+		filter = manager.tunnelGroup.filter
+	}
+	if !manager.service.wanFilter.AllowedAddr(addr) || !filter.AllowedAddr(addr) {
+		metrics.Add(metricWANConnsDenied, 1)
+		manager.log.Info("WAN connection denied by IP filter", "wan", addr)
+		return false
+	}
+
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !manager.service.ipLimiter.allow(ip) {
+		metrics.Add(metricWANConnsRateLimited, 1)
+		manager.log.Debug("WAN connection rate limited", "wan", addr)
+		return false
+	}
+
+	return true
+}
+
+// 检查隧道是否还能接受公网连接：是否超过隧道的限速，等待配对和等待PROXY protocol头部的连接是否太多
+func (manager *manager) admitWANListener(conn net.Conn) bool {
+	addr := conn.RemoteAddr()
+	if !manager.rateLimiter.allow() {
+		metrics.Add(metricWANConnsRateLimited, 1)
+		manager.log.Debug("WAN connection rate limited", "wan", addr)
+		return false
+	}
+
+	pending := atomic.LoadInt64(&manager.pendingWANConns) + atomic.LoadInt64(&manager.headerWANConns) + int64(len(manager.wanConnCh))
+	if pending >= int64(*maxPendingWANConns) {
+		metrics.Add(metricWANConnsOverflow, 1)
+		manager.log.Debug("too many pending WAN connections", "wan", addr)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"expvar"
+	"flag"
+	"net/http"
+
+	"github.com/jiajunhuang/natproxy/logger"
+)
+
+var (
+	metricsAddr = flag.String("metricsAddr", "", "serve metrics at http://<metricsAddr>/debug/vars, empty means disabled")
+
+	metrics = expvar.NewMap("natproxy")
+)
+
+// 指标名
+const (
+	metricWANConnsDenied      = "wan_conns_denied"       // 被IP过滤拒绝的公网连接
+	metricWANConnsRateLimited = "wan_conns_rate_limited" // 因为速率限制被关闭的公网连接
+	metricWANConnsOverflow    = "wan_conns_overflow"     // 等待客户端的连接太多而被关闭的公网连接
+)
+
+// 启动指标服务，expvar会把指标注册到/debug/vars
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+
+	logger.Info("serve metrics", "addr", *metricsAddr)
+	if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+		logger.Error("failed to serve metrics", "error", err)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// 令牌桶，rate为每秒产生的令牌数，burst为桶的容量
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 单个令牌桶，rate为0时不限速
+type rateLimiter struct {
+	lock   sync.Mutex
+	bucket *tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{bucket: newTokenBucket(rate, burst, time.Now())}
+}
+
+func (l *rateLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.bucket.allow(time.Now())
+}
+
+const (
+	rateLimitPruneInterval = time.Minute
+	maxRateLimitKeys       = 100000 // 超过之后新的key直接拒绝，直到清理出空位
+)
+
+// 按key(比如来源IP)分别限速
+type keyedRateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newKeyedRateLimiter(rate float64, burst int) *keyedRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &keyedRateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), lastPrune: time.Now()}
+}
+
+func (l *keyedRateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.allowAt(key, time.Now())
+}
+
+func (l *keyedRateLimiter) allowAt(key string, now time.Time) bool {
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		// 大量不同来源时最多每秒清理一次，清理不出空位就拒绝
+		if len(l.buckets) >= maxRateLimitKeys && now.Sub(l.lastPrune) > time.Second {
+			l.prune(now)
+		}
+		if len(l.buckets) >= maxRateLimitKeys {
+			return false
+		}
+		b = newTokenBucket(l.rate, l.burst, now)
+		l.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+// 删除已经装满的桶，它们和新建的桶没有区别
+func (l *keyedRateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastPrune = now
+}
+
+// 定期清理，没有新连接的时候也能释放内存
+func (l *keyedRateLimiter) pruneLoop() {
+	if l == nil {
+		return
+	}
+
+	ticker := time.NewTicker(rateLimitPruneInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.lock.Lock()
+		l.prune(now)
+		l.lock.Unlock()
+	}
+}
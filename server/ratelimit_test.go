@@ -0,0 +1,130 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+
+	// 一开始桶是满的
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("request %d within burst is denied", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("request over burst is allowed")
+	}
+
+	// 每秒2个令牌
+	now = now.Add(time.Millisecond * 500)
+	if !b.allow(now) {
+		t.Fatal("request after refill is denied")
+	}
+	if b.allow(now) {
+		t.Fatal("refilled more tokens than rate")
+	}
+
+	// 最多装满burst个
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("request %d after a long idle is denied", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("bucket holds more than burst")
+	}
+}
+
+func TestTokenBucketMinBurst(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(1, 0, now)
+	if !b.allow(now) || b.allow(now) {
+		t.Fatal("burst should be at least 1")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	if l := newRateLimiter(0, 10); l != nil || !l.allow() {
+		t.Error("rate 0 should be unlimited")
+	}
+	if l := newKeyedRateLimiter(0, 10); l != nil || !l.allow("1.2.3.4") {
+		t.Error("keyed rate 0 should be unlimited")
+	}
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newKeyedRateLimiter(1, 2)
+
+	// 每个key有自己的桶
+	for _, key := range []string{"a", "b"} {
+		if !l.allowAt(key, now) || !l.allowAt(key, now) {
+			t.Fatalf("key %s: request within burst is denied", key)
+		}
+		if l.allowAt(key, now) {
+			t.Fatalf("key %s: request over burst is allowed", key)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if !l.allowAt("a", now) {
+		t.Fatal("request after refill is denied")
+	}
+}
+
+func TestKeyedRateLimiterPrune(t *testing.T) {
+	now := time.Now()
+	l := newKeyedRateLimiter(1, 5)
+	l.allowAt("idle", now)
+	for i := 0; i < 5; i++ {
+		l.allowAt("busy", now.Add(time.Second*3))
+	}
+
+	// idle的桶已经装满，可以删掉；busy的桶还没有恢复
+	l.prune(now.Add(time.Second * 4))
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("full bucket is not pruned")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("bucket in use is pruned")
+	}
+
+	// 超过清理间隔之后，allow时会自动清理
+	l.allowAt("other", now.Add(rateLimitPruneInterval*2))
+	if _, ok := l.buckets["busy"]; ok {
+		t.Error("stale bucket is not pruned by allow")
+	}
+}
+
+func TestKeyedRateLimiterMaxKeys(t *testing.T) {
+	now := time.Now()
+	l := newKeyedRateLimiter(1, 1)
+	for i := 0; i < maxRateLimitKeys; i++ {
+		if !l.allowAt(strconv.Itoa(i), now) {
+			t.Fatalf("key %d is denied", i)
+		}
+	}
+
+	// 桶都在使用中，新的key被拒绝，已有的key不受影响
+	if l.allowAt("new", now) {
+		t.Fatal("new key is allowed when the limiter is full")
+	}
+	if len(l.buckets) != maxRateLimitKeys {
+		t.Fatalf("got %d keys, want %d", len(l.buckets), maxRateLimitKeys)
+	}
+
+	// 桶装满之后被清理出空位
+	now = now.Add(time.Second * 2)
+	if !l.allowAt("new", now) {
+		t.Fatal("new key is denied after buckets are refilled")
+	}
+	if len(l.buckets) != 1 {
+		t.Fatalf("got %d keys after prune, want 1", len(l.buckets))
+	}
+}
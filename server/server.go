@@ -2,16 +2,29 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-
-	"github.com/golang/protobuf/proto"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/accesslog"
+	"github.com/jiajunhuang/natproxy/cluster"
+	"github.com/jiajunhuang/natproxy/compression"
+	"github.com/jiajunhuang/natproxy/dial"
 	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/ipfilter"
+	"github.com/jiajunhuang/natproxy/logger"
 	"github.com/jiajunhuang/natproxy/pb"
+	"github.com/jiajunhuang/natproxy/protocol"
 	"github.com/jiajunhuang/natproxy/tools"
 	reuse "github.com/libp2p/go-reuseport"
 	"google.golang.org/grpc"
@@ -21,144 +34,664 @@ import (
 )
 
 var (
-	certFilePath = flag.String("certPath", "/root/.acme.sh/*.laizuoceshi.com/*.laizuoceshi.com.cer", "cert file path")
-	keyFilePath  = flag.String("keyPath", "/root/.acme.sh/*.laizuoceshi.com/*.laizuoceshi.com.key", "key file path")
+	certFilePath       = flag.String("certPath", "/root/.acme.sh/*.laizuoceshi.com/*.laizuoceshi.com.cer", "cert file path")
+	keyFilePath        = flag.String("keyPath", "/root/.acme.sh/*.laizuoceshi.com/*.laizuoceshi.com.key", "key file path")
+	drainTimeout       = flag.Duration("drainTimeout", time.Second*30, "max time to wait for active connections when shutting down")
+	wanAllow           = flag.String("wanAllow", "", "comma separated CIDR list, only WAN connections from these networks are allowed")
+	wanDeny            = flag.String("wanDeny", "", "comma separated CIDR list, WAN connections from these networks are denied")
+	wanRatePerIP       = flag.Float64("wanRatePerIP", 0, "max new WAN connections per second from a single IP, 0 means unlimited")
+	wanBurstPerIP      = flag.Int("wanBurstPerIP", 20, "burst of new WAN connections from a single IP")
+	wanRatePerTunnel   = flag.Float64("wanRatePerTunnel", 0, "max new WAN connections per second of a tunnel, 0 means unlimited")
+	wanBurstPerTunnel  = flag.Int("wanBurstPerTunnel", 100, "burst of new WAN connections of a tunnel")
+	maxPendingWANConns = flag.Int("maxPendingWANConns", 128, "max WAN connections of a tunnel waiting for client connections")
+	wanProxyProtocol   = flag.Bool("wanProxyProtocol", false, "read PROXY protocol header from WAN connections, use it when server is behind a load balancer")
+	handoffTimeout     = flag.Duration("handoffTimeout", time.Minute, "close inherited WAN listeners which are not claimed by clients after this duration")
+	minProtocolVersion = flag.Int("minProtocolVersion", 0, "reject clients with older protocol version, clients without handshake are version 0")
+	enableCompression  = flag.Bool("compression", true, "allow clients to compress tunnel data, tunnels fall back to uncompressed if it's false")
+	heartbeatTimeout   = flag.Duration("heartbeatTimeout", time.Second*90, "disconnect clients which negotiated heartbeat but send nothing in this duration, 0 means never")
+	httpHeaderTimeout  = flag.Duration("httpHeaderTimeout", time.Second*30, "close WAN connections of HTTP tunnels which don't send request headers in this duration, including idle keep-alive connections, 0 means never")
 )
 
 // Start gRPC server
 func Start(addr, wanIP string, bufSize int) {
-	listener, err := reuse.Listen("tcp", addr)
-	if err != nil {
-		log.Printf("failed to listen at addr %s", addr)
+	// 热升级时从父进程继承监听器
+	var err error
+	listener, inherited := inheritListeners()
+	if listener == nil {
+		listener, err = reuse.Listen("tcp", addr)
+		if err != nil {
+			logger.Error("failed to listen", "addr", addr, "error", err)
+		}
 	}
 
 	// register service
 	svc := newService(wanIP, bufSize)
-	creds, err := credentials.NewServerTLSFromFile(*certFilePath, *keyFilePath)
+	svc.inherited = inherited
+	svc.tunnelPorts = inheritTunnelPorts()
+	svc.wanFilter, err = ipfilter.New(*wanAllow, *wanDeny)
 	if err != nil {
-		log.Fatalf("failed to create credentials: %v", err)
+		logger.Fatal("bad WAN allow or deny list", "error", err)
 	}
-	server := grpc.NewServer(grpc.Creds(creds))
+	svc.ipLimiter = newKeyedRateLimiter(*wanRatePerIP, *wanBurstPerIP)
+	go svc.ipLimiter.pruneLoop()
+	svc.wanSocket = wanSocketOptions()
+	svc.dataSocket = dataSocketOptions()
+	svc.join = joinOptions()
+	go serveMetrics()
+	svc.accessLog, err = accesslog.Open()
+	if err != nil {
+		logger.Fatal("failed to open access log", "error", err)
+	}
+	defer svc.accessLog.Close()
+	svc.cluster, err = cluster.Open()
+	if err != nil {
+		logger.Fatal("failed to open cluster store", "error", err)
+	}
+	defer svc.cluster.Close()
+	go svc.heartbeat()
+	svc.tokens, err = openTokenStore(*tokenFile)
+	if err != nil {
+		logger.Fatal("failed to load token file", "error", err)
+	}
+	go svc.checkSessions(*tokenCheckInterval)
+	go svc.serveAdmin()
+	go svc.releaseInheritedListeners(*handoffTimeout)
+	cert, err := tls.LoadX509KeyPair(*certFilePath, *keyFilePath)
+	if err != nil {
+		logger.Fatal("failed to create credentials", "error", err)
+	}
+	// 控制通道和数据连接使用同一个证书，客户端会检查两者是否一致
+	svc.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
 
 	pb.RegisterServerServiceServer(server, svc)
-	log.Printf("server start to listen at %s, WAN ip is %s, bufSize is %d", addr, wanIP, bufSize)
-	if err := server.Serve(listener); err != nil {
-		log.Fatalf("failed to serve: %s", err)
+
+	// 收到SIGTERM/SIGINT之后优雅退出，收到SIGUSR2之后把监听器交给新进程再退出，收到SIGHUP之后重新读取token文件
+	stopping, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+		notifyUpgrade(sigCh)
+
+		for {
+			sig := <-sigCh
+			if sig == syscall.SIGHUP {
+				logger.Info("received signal, reload token file", "signal", sig)
+				if err := svc.reload(); err != nil {
+					logger.Error("failed to reload token file", "error", err)
+				}
+				continue
+			}
+			if isUpgradeSignal(sig) {
+				logger.Info("received signal, start to hand off listeners", "signal", sig)
+				if err := svc.handoff(listener); err != nil {
+					logger.Error("failed to hand off listeners", "error", err)
+					continue
+				}
+				// 新进程已经接管了控制端口，这里不再接受新的客户端
+				close(stopping)
+				listener.Close()
+			} else {
+				logger.Info("received signal, start to shutdown", "signal", sig)
+				close(stopping)
+			}
+
+			svc.shutdown(*drainTimeout)
+			server.GracefulStop()
+			close(stopped)
+			return
+		}
+	}()
+
+	logger.Info("server start to listen", "addr", addr, "wan_ip", wanIP, "buf_size", bufSize)
+	sdNotify("READY=1")
+	err = server.Serve(listener)
+	select {
+	case <-stopping:
+		<-stopped
+	default:
+		if err != nil {
+			logger.Fatal("failed to serve", "error", err)
+		}
 	}
+	logger.Info("server stopped")
 }
 
 type service struct {
 	wanIP   string
 	bufSize int
+
+	lock        sync.Mutex
+	draining    bool
+	managers    map[*manager]struct{}
+	inherited   map[string]net.Listener // 热升级时从父进程继承的公网监听器，按端口索引
+	tunnelPorts map[string]string       // 有名字的隧道上次使用的公网端口，按token和隧道名索引
+	activeConns int64                   // 正在转发的连接数
+	sessionSeq  int64                   // 会话编号
+	accessLog   *accesslog.Logger
+	wanFilter   *ipfilter.Filter  // 整个服务器的公网连接IP过滤
+	ipLimiter   *keyedRateLimiter // 每个来源IP的接受速率限制
+	cluster     cluster.Store     // 集群里所有服务器的会话
+	groupLock   sync.Mutex
+	groups      map[string]*tunnelGroup // 按token和分组名索引
+	tlsConfig   *tls.Config             // 客户端连接使用的TLS配置
+	tokens      *tokenStore             // 管理员管理的token
+	bytesIn     int64                   // 已结束的连接从公网收到的字节数
+	bytesOut    int64                   // 已结束的连接发往公网的字节数
+	wanSocket   *dial.SocketOptions     // 公网连接的socket参数
+	dataSocket  *dial.SocketOptions     // 客户端数据连接的socket参数
+	join        dial.JoinOptions        // 转发连接的超时
 }
 
 func newService(wanIP string, bufSize int) *service {
 	return &service{
-		wanIP:   wanIP,
-		bufSize: bufSize,
+		wanIP:       wanIP,
+		bufSize:     bufSize,
+		managers:    make(map[*manager]struct{}),
+		inherited:   make(map[string]net.Listener),
+		tunnelPorts: make(map[string]string),
+		groups:      make(map[string]*tunnelGroup),
+	}
+}
+
+// 取走继承下来的公网监听器
+func (s *service) takeInheritedListener(port string) net.Listener {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l, ok := s.inherited[port]
+	if !ok {
+		return nil
+	}
+	delete(s.inherited, port)
+	return l
+}
+
+func (s *service) hasInheritedListener(port string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.inherited[port]
+	return ok
+}
+
+// 超时之后关闭没有被客户端认领的继承监听器
+func (s *service) releaseInheritedListeners(timeout time.Duration) {
+	time.Sleep(timeout)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for port, l := range s.inherited {
+		logger.Info("inherited listener not claimed, close it", "port", port)
+		l.Close()
+		delete(s.inherited, port)
+	}
+}
+
+// 登记一个客户端会话，如果服务器正在退出则拒绝
+func (s *service) addManager(manager *manager) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.draining {
+		return errors.ErrServerShuttingDown
+	}
+	s.managers[manager] = struct{}{}
+	return nil
+}
+
+func (s *service) removeManager(manager *manager) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.managers, manager)
+}
+
+// 停止接受公网连接，通知客户端重连，等待已有连接结束或者超时，最后断开所有客户端
+func (s *service) shutdown(timeout time.Duration) {
+	s.lock.Lock()
+	s.draining = true
+	managers := make([]*manager, 0, len(s.managers))
+	for manager := range s.managers {
+		managers = append(managers, manager)
+	}
+	s.lock.Unlock()
+
+	for _, manager := range managers {
+		manager.drain()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		active := atomic.LoadInt64(&s.activeConns)
+		if active == 0 {
+			logger.Info("all connections finished")
+			break
+		}
+		if time.Now().After(deadline) {
+			logger.Warn("drain timeout", "active_conns", active)
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	for _, manager := range managers {
+		manager.stop()
 	}
 }
 
-func (s *service) Msg(stream pb.ServerService_MsgServer) error {
+func (s *service) Msg(stream pb.ServerService_MsgServer) (err error) {
 	manager := newManager(s, s.bufSize)
-	defer close(manager.msgCh)
+	// 其他goroutine还可能发送消息，不关闭msgCh，而是通过stopCh通知它们会话已经结束
+	defer manager.stop()
+
+	// 告诉客户端出错的原因，以及是否应该重试
+	defer func() {
+		if err == nil {
+			return
+		}
+		msg := &pb.MsgResponse{Type: pb.MsgType_Error, Payload: &pb.MsgResponse_Error{Error: errorInfo(err)}}
+		if sendErr := manager.send(stream, msg); sendErr != nil {
+			logger.Debug("failed to send error to client", "error", sendErr)
+		}
+	}()
 
 	ctx := stream.Context()
 	token := getToken(ctx)
 
 	// 获取客户端信息
 	client, ok := peer.FromContext(ctx)
-	log.Printf("client(%s) connected, ok: %t", client, ok)
-	defer log.Printf("client(%s) disconnected", client)
+	clientAddr := ""
+	if ok {
+		clientAddr = client.Addr.String()
+	}
+	seq := atomic.AddInt64(&s.sessionSeq, 1)
+	log := logger.With("session", seq, "token", token, "client", clientAddr)
+	manager.log = log
+	manager.id, manager.token, manager.clientAddr, manager.since = seq, token, clientAddr, time.Now()
+	options, err := parseTunnelOptions(ctx)
+	if err != nil {
+		log.Warn("bad tunnel options", "error", err)
+		return errors.ErrBadMetadata
+	}
+	if err := s.addManager(manager); err != nil {
+		log.Warn("refuse new client", "error", err)
+		return err
+	}
+	defer s.removeManager(manager)
+	manager.rateLimiter = newRateLimiter(*wanRatePerTunnel, *wanBurstPerTunnel)
 
-	// 启动公网端口监听 && 下发消息给客户端告知公网地址
-	wanListener, wanListenerAddr, err := s.getWANListen(ctx)
+	// 握手：确认协议版本和双方都支持的功能，旧版本客户端不发送握手，第一条消息交给消息处理器
+	first, hs, err := s.handshake(stream, manager)
 	if err != nil {
-		log.Printf("failed to create listener for WAN: %s", err)
+		log.Warn("handshake failed", "error", err)
+		return err
+	}
+
+	// metadata只表示客户端想要用的功能，双方都支持才启用
+	manager.pairByID = getMetadata(ctx, "natproxy-conn-id") != "" && manager.has(protocol.FeatureConnID)
+	manager.dataTLS = getMetadata(ctx, "natproxy-data-tls") != "" && manager.has(protocol.FeatureDataTLS)
+	if !manager.has(protocol.FeatureCompression) {
+		options.compression = compression.None
+	}
+	manager.options = options
+
+	// 告诉客户端最终使用的压缩算法，header要在第一条消息之前发送
+	if err := stream.SendHeader(metadata.Pairs("natproxy-compress", options.compression)); err != nil {
+		log.Warn("failed to send header", "error", err)
+		return err
+	}
+	if hs != nil {
+		if err := manager.send(stream, &pb.MsgResponse{Type: pb.MsgType_Handshake, Payload: &pb.MsgResponse_Handshake{Handshake: hs}}); err != nil {
+			log.Warn("handshake failed", "error", err)
+			return err
+		}
+		if hs.Reason != "" {
+			log.Warn("handshake failed", "error", errors.ErrClientTooOld)
+			return errors.ErrClientTooOld
+		}
+	}
+	log.Info("client connected", "protocol_version", manager.protocolVersion, "features", strings.Join(manager.features, ","))
+	defer log.Info("client disconnected")
+
+	// token的权限范围限制了隧道类型和分组，分组需要双方都支持
+	groupName := getMetadata(ctx, "natproxy-group")
+	if groupName != "" && !manager.has(protocol.FeatureGroup) {
+		log.Warn("client doesn't negotiate group", "group", groupName)
+		return errors.ErrNotSupport
+	}
+	if err := s.checkScopes(token, options, groupName); err != nil {
+		log.Warn("token is not allowed to open the tunnel", "group", groupName, "error", err)
 		return err
 	}
-	defer wanListener.Close()
-	log.Printf("client(%s, token: %s)'s WAN listener listen at %s", client, token, wanListenerAddr)
-	go manager.receiveConnFromWAN(client, wanListener)
-	manager.msgCh <- &pb.MsgResponse{Type: pb.MsgType_WANAddr, Data: []byte(wanListenerAddr)}
+
+	// 在集群里登记会话，同一个token只能在一台服务器上在线，避免重复分配公网地址
+	session := &cluster.Session{
+		ID:     fmt.Sprintf("%s/%d/%d", s.cluster.Node(), os.Getpid(), seq),
+		Token:  logger.TokenHash(token),
+		Group:  groupName,
+		Client: clientAddr,
+		Since:  time.Now(),
+	}
+	if err := s.cluster.Claim(session); err != nil {
+		log.Warn("failed to claim session", "error", err)
+		return err
+	}
+	defer s.cluster.Release(session.ID)
+
+	// 启动公网端口监听 && 下发消息给客户端告知公网地址，分组的客户端共享公网监听
+	var wanListener net.Listener
+	var wanListenerAddr string
+	if groupName != "" {
+		group, err := s.joinGroup(ctx, manager, groupName)
+		if err != nil {
+			log.Error("failed to join group", "group", groupName, "error", err)
+			return err
+		}
+		defer s.leaveGroup(group, manager)
+		wanListener, wanListenerAddr = group.listener, group.addr
+		log = log.With("group", groupName)
+	} else {
+		wanListener, wanListenerAddr, err = s.getWANListen(ctx, token, options.name)
+		if err != nil {
+			log.Error("failed to create listener for WAN", "error", err)
+			return err
+		}
+		defer wanListener.Close()
+		go manager.receiveConnFromWAN(client, wanListener)
+	}
+	manager.setWANListener(wanListener)
+	log = log.With("tunnel", wanListenerAddr)
+	manager.log = log
+	manager.infoMu.Lock()
+	manager.tunnel, manager.group = wanListenerAddr, groupName
+	manager.infoMu.Unlock()
+	log.Info("WAN listener listen")
+	session.Tunnel = wanListenerAddr
+	if err := s.cluster.Claim(session); err != nil {
+		log.Warn("failed to update session", "error", err)
+	}
+	manager.msgCh <- &pb.MsgResponse{Type: pb.MsgType_WANAddr, Payload: &pb.MsgResponse_WanAddr{WanAddr: &pb.WANAddrAssigned{Addr: wanListenerAddr}}}
 
 	// 启动客户端监听
 	// ref: https://en.wikipedia.org/wiki/Ephemeral_port 一般Linux的port范围是32768 ~ 61000
 	clientListener, clientListenerAddr, err := s.createListenerByPort("0")
 	if err != nil {
-		log.Printf("failed to create listener for client: %s", err)
+		log.Error("failed to create listener for client", "error", err)
 		return err
 	}
 	defer clientListener.Close()
-	log.Printf("client(%s, token: %s) listener listen at %s", client, token, clientListenerAddr)
+	log.Info("client listener listen", "client_listener", clientListenerAddr)
 	go manager.receiveConnFromClient(client, clientListener)
 
 	// 处理来自公网请求
 	go manager.handleConnFromWAN(clientListenerAddr)
 
 	// 接收来自客户端的gRPC请求
-	go manager.receiveMsgFromClient(stream)
+	go manager.receiveMsgFromClient(stream, first)
+
+	// 协商了心跳的客户端太久没有消息就断开
+	var heartbeat <-chan time.Time
+	var heartbeatTimer *time.Timer
+	if manager.has(protocol.FeatureHeartbeat) && *heartbeatTimeout > 0 {
+		heartbeatTimer = time.NewTimer(*heartbeatTimeout)
+		defer heartbeatTimer.Stop()
+		heartbeat = heartbeatTimer.C
+	}
 
 	// 启动客户端下发消息器
+	drainCh := manager.drainCh
 	for {
 		select {
-		case msg, ok := <-manager.msgCh:
-			if !ok {
-				log.Printf("message(to client) channel closed")
-				return errors.ErrMsgChanClosed
+		case <-drainCh:
+			// 服务器准备退出，不再接受新的公网连接，支持的客户端会收到通知马上重连
+			drainCh = nil
+			manager.closeWANListener()
+			if !manager.has(protocol.FeatureReconnect) {
+				continue
 			}
-
-			if err := stream.Send(msg); err != nil {
-				log.Printf("failed to send message(%s): %s", msg, err)
+			reconnect := &pb.MsgResponse{Type: pb.MsgType_Reconnect, Payload: &pb.MsgResponse_Reconnect{Reconnect: &pb.ReconnectRequest{}}}
+			if err := manager.send(stream, reconnect); err != nil {
+				log.Warn("failed to send reconnect message", "error", err)
 			}
-			log.Printf("successfully send message(%s) to client", msg)
+			log.Info("notified client to reconnect")
+		case <-heartbeat:
+			log.Warn("client sends no heartbeat", "timeout", *heartbeatTimeout)
+			return errors.ErrHeartbeatTimeout
+		case <-manager.stopCh:
+			if manager.stopErr != nil {
+				log.Info("session is kicked", "reason", manager.stopErr)
+				return manager.stopErr
+			}
+			log.Info("server is shutting down, disconnect client")
+			return errors.ErrServerShuttingDown
+		case msg := <-manager.msgCh:
+			if err := manager.send(stream, msg); err != nil {
+				log.Warn("failed to send message", "msg_type", msg.Type, "error", err)
+			}
+			log.Debug("successfully send message to client", "msg_type", msg.Type)
 		case msg, ok := <-manager.clientMsgCh:
 			if !ok {
 				return errors.ErrMsgChanClosed
 			}
-			switch msg.Type {
-			case pb.MsgType_DisConnect:
-				log.Printf("client(%s, token: %s) ask me to disconnect", client, token)
+			if heartbeatTimer != nil {
+				if !heartbeatTimer.Stop() {
+					<-heartbeatTimer.C
+				}
+				heartbeatTimer.Reset(*heartbeatTimeout)
+			}
+			if msg, err = msg.Typed(); err != nil {
+				log.Warn("failed to unmarshal message", "error", err)
+				continue
+			}
+			switch payload := msg.Payload.(type) {
+			case *pb.MsgRequest_Disconnect:
+				log.Info("client ask me to disconnect")
 				return nil
-			case pb.MsgType_Report:
-				var clientInfo pb.ClientInfo
-				if err = proto.Unmarshal(msg.Data, &clientInfo); err != nil {
-					log.Printf("failed to unmarshal client info %s: %s", msg.Data, err)
+			case *pb.MsgRequest_Report:
+				clientInfo := payload.Report
+				log.Info("client report info", "os", clientInfo.Os, "arch", clientInfo.Arch, "version", clientInfo.Version)
+				manager.infoMu.Lock()
+				manager.clientVersion = clientInfo.Version
+				manager.infoMu.Unlock()
+			case *pb.MsgRequest_Ping:
+				pong := &pb.MsgResponse{Type: pb.MsgType_Ping, Payload: &pb.MsgResponse_Ping{Ping: payload.Ping}}
+				if err := manager.send(stream, pong); err != nil {
+					log.Warn("failed to send pong", "error", err)
 				}
-				log.Printf("client(%s, token: %s) report info %+v", client, token, clientInfo)
+			case *pb.MsgRequest_Error:
+				log.Warn("client report error", "error", payload.Error.Message)
 			default:
-				log.Printf("client send bad message %s", msg)
+				log.Warn("client send bad message", "msg_type", msg.Type)
 			}
 		}
 	}
 }
 
-// 获得公网监听
-func (s *service) getWANListen(ctx context.Context) (net.Listener, string, error) {
-	token := getToken(ctx)
+// 读取客户端的握手消息并协商功能，返回要回复的握手消息，版本太旧时其中带有拒绝的原因。旧版本
+// 客户端第一条消息不是握手，返回给调用者继续处理
+func (s *service) handshake(stream pb.ServerService_MsgServer, manager *manager) (*pb.MsgRequest, *pb.HandshakeInfo, error) {
+	msg, err := stream.Recv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg, err = msg.Typed(); err != nil {
+		return nil, nil, errors.ErrBadRequest
+	}
+	hs := msg.GetHandshake()
+	if hs == nil {
+		if *minProtocolVersion > 0 {
+			return nil, nil, errors.ErrClientTooOld
+		}
+		return msg, nil, nil
+	}
+	manager.protocolVersion = hs.ProtocolVersion
+
+	resp := &pb.HandshakeInfo{ProtocolVersion: protocol.Version}
+	if hs.ProtocolVersion < uint32(*minProtocolVersion) {
+		resp.Reason = fmt.Sprintf("protocol version %d is too old, %d at least, please upgrade", hs.ProtocolVersion, *minProtocolVersion)
+	} else {
+		manager.features = protocol.Negotiate(protocol.Features, hs.Features)
+		manager.typedMsgs = manager.has(protocol.FeatureTypedMessages)
+		resp.Features = manager.features
+		if manager.has(protocol.FeatureHeartbeat) {
+			resp.HeartbeatTimeoutMs = int64(*heartbeatTimeout / time.Millisecond)
+		}
+	}
+
+	return nil, resp, nil
+}
+
+// 定期告诉集群里其他服务器本机还活着
+func (s *service) heartbeat() {
+	if err := s.cluster.Heartbeat(); err != nil {
+		logger.Warn("failed to heartbeat", "error", err)
+	}
+
+	ticker := time.NewTicker(cluster.HeartbeatInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.cluster.Heartbeat(); err != nil {
+			logger.Warn("failed to heartbeat", "error", err)
+		}
+	}
+}
 
-	listenAddr, err := s.getListenAddrByToken(token)
+// 获得公网监听
+func (s *service) getWANListen(ctx context.Context, token, name string) (net.Listener, string, error) {
+	var listenAddr string
+	var err error
+	if name == "" {
+		if err := s.waitRotated(ctx, token); err != nil {
+			return nil, "", err
+		}
+		listenAddr, err = s.getListenAddrByToken(token)
+	} else {
+		listenAddr, err = s.getListenAddrByTunnel(token, name)
+	}
 	if err != nil {
 		return nil, listenAddr, err
 	}
 	addrList := strings.Split(listenAddr, ":")
 	port := addrList[len(addrList)-1]
 
-	return s.createListenerByPort(port)
+	listener, addr, err := s.createListenerByPort(port)
+	if err == nil && name != "" {
+		s.lock.Lock()
+		s.tunnelPorts[token+"/"+name] = port
+		s.lock.Unlock()
+	}
+	return listener, addr, err
+}
+
+// 同一个token的其他隧道按名字分配端口，预留端口和注册中心登记的地址留给默认隧道。这些端口不在
+// 注册中心登记，只记在内存里，热升级时交给子进程，隧道重连时尽量使用原来的端口
+func (s *service) getListenAddrByTunnel(token, name string) (string, error) {
+	log := logger.With("token", token, "tunnel_name", name)
+
+	entry := s.tokens.get(token)
+	if err := entry.validate(time.Now()); err != nil {
+		return "", err
+	}
+	var registered string
+	if !entry.Local {
+		var err error
+		registered, err = tools.GetAddrByToken(token)
+		if err == errors.ErrTokenNotValid {
+			return "", err
+		}
+		if err != nil {
+			log.Error("failed to query addr of token", "error", err)
+			return "", errors.ErrRegistryUnavailable
+		}
+	}
+
+	s.lock.Lock()
+	lastPort := s.tunnelPorts[token+"/"+name]
+	s.lock.Unlock()
+	if port, _ := strconv.Atoi(lastPort); port != 0 && !s.tokens.reservedByOther(port, token) && entry.allowsPort(port) {
+		if s.hasInheritedListener(lastPort) {
+			return fmt.Sprintf("0.0.0.0:%s", lastPort), nil
+		}
+		listenerAddr := fmt.Sprintf("0.0.0.0:%s", lastPort)
+		l, err := net.Listen("tcp", listenerAddr)
+		if err == nil {
+			l.Close()
+			return listenerAddr, nil
+		}
+		log.Info("failed to listen, try to find another one", "addr", listenerAddr, "error", err)
+	}
+
+	for retry := 0; retry <= 20; retry++ {
+		port := s.getRandomPort(entry.portRanges())
+		addr := fmt.Sprintf("%s:%d", s.wanIP, port)
+		if port == entry.Port || addr == registered || s.tokens.reservedByOther(port, token) {
+			continue
+		}
+		l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+		if err != nil {
+			log.Debug("port can't be listened", "port", port, "error", err)
+			continue
+		}
+		l.Close()
+
+		if !entry.Local {
+			taken, err := tools.CheckIfAddrAlreadyTaken(addr)
+			if err != nil {
+				log.Error("failed to check if addr already been taken by others", "addr", addr, "error", err)
+				return "", errors.ErrRegistryUnavailable
+			}
+			if taken {
+				log.Debug("addr had been taken", "addr", addr)
+				continue
+			}
+		}
+		return addr, nil
+	}
+	return "", errors.ErrFailedToAllocatePort
 }
 
 // 根据token查询
 func (s *service) getListenAddrByToken(token string) (string, error) {
-	addr, err := tools.GetAddrByToken(token)
-	if err != nil {
+	log := logger.With("token", token)
+
+	// 管理员创建的token不需要询问注册中心，吊销或者过期的token直接拒绝
+	entry := s.tokens.get(token)
+	if err := entry.validate(time.Now()); err != nil {
 		return "", err
 	}
+	var addr string
+	if !entry.Local {
+		var err error
+		addr, err = tools.GetAddrByToken(token)
+		if err == errors.ErrTokenNotValid {
+			return "", err
+		}
+		if err != nil {
+			log.Error("failed to query addr of token", "error", err)
+			return "", errors.ErrRegistryUnavailable
+		}
+	}
+
+	// 管理员预留了端口
+	if entry.Port != 0 {
+		return fmt.Sprintf("0.0.0.0:%d", entry.Port), nil
+	}
 
 	// 如果已经分配过公网地址
 	if addr != "" {
 		addrList := strings.Split(addr, ":")
-		// 如果上次分配的地址是本机，那么直接返回，否则，就应该重新分配
-		if addrList[0] == s.wanIP {
+		// 如果上次分配的地址是本机，那么直接返回，否则，就应该重新分配。端口被预留给别人或者不在
+		// token的权限范围内的也要重新分配
+		lastPort, _ := strconv.Atoi(addrList[len(addrList)-1])
+		if addrList[0] == s.wanIP && !s.tokens.reservedByOther(lastPort, token) && entry.allowsPort(lastPort) {
+			// 热升级时端口已经由父进程交接过来，直接使用
+			port := addrList[len(addrList)-1]
+			if s.hasInheritedListener(port) {
+				return fmt.Sprintf("0.0.0.0:%s", port), nil
+			}
+
 			// 尝试监听一下，如果没有问题，就返回，如果有问题，就重新分配一个
 			listenerAddr := fmt.Sprintf("0.0.0.0:%s", addrList[len(addrList)-1])
 			l, err := net.Listen("tcp", listenerAddr)
@@ -167,7 +700,7 @@ func (s *service) getListenAddrByToken(token string) (string, error) {
 				return listenerAddr, nil
 			}
 
-			log.Printf("failed to listen at %s: %s, try to find another one", listenerAddr, err)
+			log.Info("failed to listen, try to find another one", "addr", listenerAddr, "error", err)
 		}
 	}
 
@@ -178,34 +711,43 @@ func (s *service) getListenAddrByToken(token string) (string, error) {
 			return "", errors.ErrFailedToAllocatePort
 		}
 
-		port := s.getRandomPort()
-		log.Printf("trying to listen port %d", port)
+		port := s.getRandomPort(entry.portRanges())
+		if s.tokens.reservedByOther(port, token) {
+			retry++
+			continue
+		}
+		log.Debug("trying to listen port", "port", port)
 		l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
 		if err != nil {
-			log.Printf("port(%d) can't be listened: %s", port, err)
+			log.Debug("port can't be listened", "port", port, "error", err)
 			retry++
 			continue
 		}
 		l.Close()
-		log.Printf("port(%d) is ok to listen, try to check if the port is already taken by others", port)
+
+		// 管理员创建的token不在注册中心登记
+		if entry.Local {
+			return fmt.Sprintf("%s:%d", s.wanIP, port), nil
+		}
+		log.Debug("port is ok to listen, try to check if the port is already taken by others", "port", port)
 
 		// 检查一下是否被其他用户分配过
 		addr = fmt.Sprintf("%s:%d", s.wanIP, port)
 		taken, err := tools.CheckIfAddrAlreadyTaken(addr)
 		if err != nil {
-			log.Printf("failed to check if addr(%s) already been taken by others: %s", addr, err)
-			return "", err
+			log.Error("failed to check if addr already been taken by others", "addr", addr, "error", err)
+			return "", errors.ErrRegistryUnavailable
 		}
 
 		if taken {
-			log.Printf("addr(%s) had been taken", addr)
+			log.Debug("addr had been taken", "addr", addr)
 			retry++
 			continue
 		}
 
 		if err = tools.RegisterAddr(token, addr); err != nil {
-			log.Printf("failed to register addr %s: %s", addr, err)
-			return "", err
+			log.Error("failed to register addr", "addr", addr, "error", err)
+			return "", errors.ErrFailedToRegisterAddr
 		}
 
 		return addr, nil
@@ -214,21 +756,33 @@ func (s *service) getListenAddrByToken(token string) (string, error) {
 
 // 根据给定的地址创建一个监听器
 func (s *service) createListenerByPort(port string) (net.Listener, string, error) {
+	if listener := s.takeInheritedListener(port); listener != nil {
+		return listener, fmt.Sprintf("%s:%s", s.wanIP, port), nil
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%s", port))
 	if err != nil {
-		log.Printf("failed to listen at 0.0.0.0:%s: %s", port, err)
+		logger.Warn("failed to listen", "port", port, "error", err)
 		return nil, "", err
 	}
-	addrList := strings.Split(listener.Addr().String(), ":")
-	port = addrList[len(addrList)-1]
 
-	return listener, fmt.Sprintf("%s:%s", s.wanIP, port), nil
+	return listener, fmt.Sprintf("%s:%s", s.wanIP, listenerPort(listener)), nil
+}
+
+// 获取监听器的端口
+func listenerPort(listener net.Listener) string {
+	addrList := strings.Split(listener.Addr().String(), ":")
+	return addrList[len(addrList)-1]
 }
 
-// 没有分配过公网监听地址，那就在 15000 ~ 32767 之间分配一个
-func (s *service) getRandomPort() int {
+// 没有分配过公网监听地址，那就在 15000 ~ 32767 之间分配一个，token限制了端口范围的话在范围内分配
+func (s *service) getRandomPort(ranges [][2]int) int {
 	max := 32767
 	min := 15000
+	if len(ranges) > 0 {
+		r := ranges[rand.Intn(len(ranges))]
+		min, max = r[0], r[1]+1
+	}
 
 	return rand.Intn(max-min) + min
 }
@@ -236,14 +790,85 @@ func (s *service) getRandomPort() int {
 func getToken(ctx context.Context) string {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		log.Printf("bad metadata %s", md)
+		logger.Warn("bad metadata")
 		return ""
 	}
 	token := md.Get("natproxy-token")
 	if len(token) != 1 {
-		log.Printf("bad token(%s) in metadata", token)
+		logger.Warn("bad token in metadata", "count", len(token))
 		return ""
 	}
 
 	return token[0]
 }
+
+// 获取客户端在metadata中设置的值，不存在时返回空字符串
+func getMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// 隧道类型
+const (
+	tunnelTypeTCP  = "tcp"
+	tunnelTypeHTTP = "http"
+)
+
+// 隧道名最长的长度
+const maxTunnelNameLen = 64
+
+// 客户端通过metadata设置的隧道选项
+type tunnelOptions struct {
+	http      bool   // 解析HTTP请求，而不是直接转发TCP
+	httpHost  string // 把Host头改写为这个值
+	basicAuth string // HTTP basic认证的user:password
+	bearer    string // HTTP bearer认证的token
+
+	compression string // 客户端连接使用的压缩算法
+
+	name string // 隧道名，同一个token的每个隧道按名字使用自己的公网端口，默认隧道为空
+
+	filter      *ipfilter.Filter // 这个隧道的公网连接IP过滤
+	filterRules string           // 过滤规则的允许和拒绝列表，同一个分组的成员必须使用相同的规则
+}
+
+func parseTunnelOptions(ctx context.Context) (tunnelOptions, error) {
+	allow, deny := getMetadata(ctx, "natproxy-allow"), getMetadata(ctx, "natproxy-deny")
+	filter, err := ipfilter.New(allow, deny)
+	if err != nil {
+		return tunnelOptions{}, err
+	}
+
+	// 客户端要求的压缩算法不支持时拒绝注册，服务器关闭压缩时则告诉客户端不压缩
+	algo := getMetadata(ctx, "natproxy-compress")
+	if !compression.Supported(algo) {
+		return tunnelOptions{}, errors.ErrNotSupport
+	}
+	if !*enableCompression {
+		algo = compression.None
+	}
+
+	name := getMetadata(ctx, "natproxy-tunnel-name")
+	if len(name) > maxTunnelNameLen {
+		return tunnelOptions{}, errors.ErrBadMetadata
+	}
+
+	return tunnelOptions{
+		http:        getMetadata(ctx, "natproxy-tunnel-type") == tunnelTypeHTTP,
+		httpHost:    getMetadata(ctx, "natproxy-http-host"),
+		basicAuth:   getMetadata(ctx, "natproxy-http-auth"),
+		bearer:      getMetadata(ctx, "natproxy-http-bearer"),
+		compression: algo,
+		name:        name,
+		filter:      filter,
+		filterRules: allow + "|" + deny,
+	}, nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"flag"
+
+	"github.com/jiajunhuang/natproxy/dial"
+)
+
+var (
+	wanKeepAlive    = flag.Duration("wanKeepAlive", 0, "TCP keepalive period of WAN connections, 0 means OS default, negative means disabled")
+	wanIdleTimeout  = flag.Duration("wanIdleTimeout", 0, "close WAN connections which read or write nothing in this duration, 0 means never")
+	wanNoDelay      = flag.Bool("wanNoDelay", true, "set TCP_NODELAY on WAN connections")
+	wanReadBuffer   = flag.Int("wanReadBuffer", 0, "SO_RCVBUF of WAN connections in bytes, 0 means OS default")
+	wanWriteBuffer  = flag.Int("wanWriteBuffer", 0, "SO_SNDBUF of WAN connections in bytes, 0 means OS default")
+	dataKeepAlive   = flag.Duration("dataKeepAlive", 0, "TCP keepalive period of data connections dialed back by clients, 0 means OS default, negative means disabled")
+	dataIdleTimeout = flag.Duration("dataIdleTimeout", 0, "close data connections which read or write nothing in this duration, 0 means never")
+	dataNoDelay     = flag.Bool("dataNoDelay", true, "set TCP_NODELAY on data connections")
+	dataReadBuffer  = flag.Int("dataReadBuffer", 0, "SO_RCVBUF of data connections in bytes, 0 means OS default")
+	dataWriteBuffer = flag.Int("dataWriteBuffer", 0, "SO_SNDBUF of data connections in bytes, 0 means OS default")
+	connIdleTimeout = flag.Duration("connIdleTimeout", 0, "close proxied connections which have no bytes in either direction in this duration, 0 means never")
+	connMaxLifetime = flag.Duration("connMaxLifetime", 0, "close proxied connections which live longer than this, 0 means no limit")
+	connHalfClose   = flag.Duration("connHalfCloseTimeout", 0, "close proxied connections whose other direction doesn't end in this duration after one direction ends, 0 means 1m, negative means never")
+)
+
+// 公网连接的socket参数
+func wanSocketOptions() *dial.SocketOptions {
+	return &dial.SocketOptions{
+		IdleTimeout: *wanIdleTimeout,
+		KeepAlive:   *wanKeepAlive,
+		Delay:       !*wanNoDelay,
+		ReadBuffer:  *wanReadBuffer,
+		WriteBuffer: *wanWriteBuffer,
+	}
+}
+
+// 客户端连回来的数据连接的socket参数
+func dataSocketOptions() *dial.SocketOptions {
+	return &dial.SocketOptions{
+		IdleTimeout: *dataIdleTimeout,
+		KeepAlive:   *dataKeepAlive,
+		Delay:       !*dataNoDelay,
+		ReadBuffer:  *dataReadBuffer,
+		WriteBuffer: *dataWriteBuffer,
+	}
+}
+
+// 公网连接和客户端连接串起来之后的超时
+func joinOptions() dial.JoinOptions {
+	return dial.JoinOptions{IdleTimeout: *connIdleTimeout, MaxLifetime: *connMaxLifetime, HalfCloseTimeout: *connHalfClose}
+}
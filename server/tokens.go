@@ -0,0 +1,542 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+	"github.com/jiajunhuang/natproxy/logger"
+	"github.com/jiajunhuang/natproxy/tools"
+)
+
+var (
+	tokenFile          = flag.String("tokenFile", "", "json file of tokens created by admin, revoked tokens and reserved ports, empty means they are kept in memory only")
+	tokenCheckInterval = flag.Duration("tokenCheckInterval", time.Minute*5, "re-check tokens of live sessions in this interval, kick sessions whose token is revoked or expired, 0 means disabled")
+)
+
+// 新token的会话最多等这么久，等旧token的会话让出预留端口
+const rotatedWaitTimeout = time.Second * 30
+
+// 权限范围，如 tunnel:http、port:20000-20100、group:web，同一类写了多个时满足一个即可，
+// 没有写的类不限制
+const (
+	scopeTunnel = "tunnel" // token可以使用的隧道类型
+	scopePort   = "port"   // token可以使用的公网端口，单个端口或者范围
+	scopeGroup  = "group"  // token可以加入的分组
+)
+
+// TokenEntry is a token managed by admin of this server
+type TokenEntry struct {
+	Token     string    `json:"token"`
+	Local     bool      `json:"local,omitempty"`   // 管理员创建的，不需要问注册中心
+	Revoked   bool      `json:"revoked,omitempty"` // 即使注册中心认为有效也拒绝
+	Port      int       `json:"port,omitempty"`    // 预留的公网端口，0表示随机分配
+	Note      string    `json:"note,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitempty"` // 零值表示永不过期
+	Scopes    []string  `json:"scopes,omitempty"`  // 为空表示没有限制
+	RotatedTo string    `json:"rotated_to,omitempty"`
+}
+
+// token在now时是否可以使用
+func (e *TokenEntry) validate(now time.Time) error {
+	if e.Revoked {
+		return errors.ErrTokenNotValid
+	}
+	if !e.Expires.IsZero() && now.After(e.Expires) {
+		return errors.ErrTokenExpired
+	}
+	return nil
+}
+
+// kind类的权限范围是否允许value
+func (e *TokenEntry) allows(kind, value string) bool {
+	limited := false
+	for _, scope := range e.Scopes {
+		k, v := splitScope(scope)
+		if k != kind {
+			continue
+		}
+		limited = true
+		if v == value || v == "*" {
+			return true
+		}
+	}
+	return !limited
+}
+
+// token可以使用的端口，nil表示任意端口
+func (e *TokenEntry) portRanges() [][2]int {
+	var ranges [][2]int
+	for _, scope := range e.Scopes {
+		if k, v := splitScope(scope); k == scopePort {
+			if min, max, err := parsePortRange(v); err == nil {
+				ranges = append(ranges, [2]int{min, max})
+			}
+		}
+	}
+	return ranges
+}
+
+func (e *TokenEntry) allowsPort(port int) bool {
+	ranges := e.portRanges()
+	for _, r := range ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return len(ranges) == 0
+}
+
+func splitScope(scope string) (string, string) {
+	if i := strings.Index(scope, ":"); i >= 0 {
+		return scope[:i], scope[i+1:]
+	}
+	return scope, ""
+}
+
+// 20000 或者 20000-20100
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.ErrBadScope
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, errors.ErrBadScope
+		}
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return 0, 0, errors.ErrBadScope
+	}
+	return min, max, nil
+}
+
+func checkScopes(scopes []string) error {
+	for _, scope := range scopes {
+		kind, value := splitScope(scope)
+		switch {
+		case value == "":
+			return errors.ErrBadScope
+		case kind == scopeTunnel && value != "tcp" && value != "http" && value != "*":
+			return errors.ErrBadScope
+		case kind == scopePort:
+			if _, _, err := parsePortRange(value); err != nil {
+				return err
+			}
+		case kind != scopeTunnel && kind != scopeGroup:
+			return errors.ErrBadScope
+		}
+	}
+	return nil
+}
+
+// 管理员管理的token，保存在-tokenFile里，修改后立即写回文件
+type tokenStore struct {
+	path string
+
+	lock   sync.RWMutex
+	tokens map[string]*TokenEntry
+}
+
+func openTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path, tokens: make(map[string]*TokenEntry)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 重新读取文件，文件不存在时为空
+func (s *tokenStore) reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var entries []*TokenEntry
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+	}
+
+	tokens := make(map[string]*TokenEntry, len(entries))
+	for _, entry := range entries {
+		tokens[entry.Token] = entry
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens = tokens
+	return nil
+}
+
+// 写回文件，调用者需要持有锁
+func (s *tokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *tokenStore) listLocked() []TokenEntry {
+	entries := make([]TokenEntry, 0, len(s.tokens))
+	for _, entry := range s.tokens {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+	return entries
+}
+
+func (s *tokenStore) list() []TokenEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.listLocked()
+}
+
+// 返回token的记录，管理员没有管理这个token时返回零值
+func (s *tokenStore) get(token string) TokenEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if entry, ok := s.tokens[token]; ok {
+		return *entry
+	}
+	return TokenEntry{Token: token}
+}
+
+// port是否被其他token预留，轮换之后端口属于新token
+func (s *tokenStore) reservedByOther(port int, token string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, entry := range s.tokens {
+		if entry.Port == port && entry.Token != token && entry.RotatedTo == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 没有管理过的token先建一个记录
+func (s *tokenStore) entryLocked(token string) *TokenEntry {
+	entry, ok := s.tokens[token]
+	if !ok {
+		entry = &TokenEntry{Token: token, Created: time.Now()}
+		s.tokens[token] = entry
+	}
+	return entry
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ttl为0表示不过期
+func (s *tokenStore) create(note string, port int, ttl time.Duration, scopes []string) (TokenEntry, error) {
+	if err := checkScopes(scopes); err != nil {
+		return TokenEntry{}, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return TokenEntry{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry := s.entryLocked(token)
+	entry.Local, entry.Note, entry.Scopes = true, note, scopes
+	if ttl > 0 {
+		entry.Expires = entry.Created.Add(ttl)
+	}
+	if port != 0 {
+		if err := s.reserveLocked(token, port); err != nil {
+			delete(s.tokens, token)
+			return TokenEntry{}, err
+		}
+	}
+	return *entry, s.save()
+}
+
+// 修改过期时间和权限范围，ttl为0表示不修改，ttl小于0表示不过期，scopes为nil表示不修改
+func (s *tokenStore) update(token string, ttl time.Duration, scopes []string) (TokenEntry, error) {
+	if err := checkScopes(scopes); err != nil {
+		return TokenEntry{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 注册中心的token也可以限制，先建一个记录
+	entry := s.entryLocked(token)
+	if scopes != nil && entry.Port != 0 {
+		if !(&TokenEntry{Scopes: scopes}).allowsPort(entry.Port) {
+			return TokenEntry{}, errors.ErrPermissionDenied
+		}
+	}
+	switch {
+	case ttl > 0:
+		entry.Expires = time.Now().Add(ttl)
+	case ttl < 0:
+		entry.Expires = time.Time{}
+	}
+	if scopes != nil {
+		entry.Scopes = scopes
+	}
+	return *entry, s.save()
+}
+
+// 轮换token：新token继承预留端口、权限范围和过期时间，旧token在grace之后失效，grace为0时立即吊销。
+// 宽限期内旧token的会话继续使用预留端口，结束之后新token的会话才能监听，见waitRotated。
+// 只能轮换管理员创建的token，注册中心的token是注册中心发的，服务器生成的新token注册中心不认，
+// 只能吊销之后让用户重新登录
+func (s *tokenStore) rotate(token string, grace time.Duration) (TokenEntry, error) {
+	newTok, err := newToken()
+	if err != nil {
+		return TokenEntry{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.tokens[token]
+	if !ok || !old.Local {
+		// 注册中心的token由注册中心管理
+		return TokenEntry{}, errors.ErrNotSupport
+	}
+	if err := old.validate(time.Now()); err != nil {
+		return TokenEntry{}, err
+	}
+	if old.RotatedTo != "" {
+		return TokenEntry{}, errors.ErrTokenRotated
+	}
+
+	entry := s.entryLocked(newTok)
+	entry.Local, entry.Port, entry.Note, entry.Expires, entry.Scopes = true, old.Port, old.Note, old.Expires, old.Scopes
+	old.RotatedTo = newTok
+	if grace > 0 {
+		if expires := time.Now().Add(grace); old.Expires.IsZero() || expires.Before(old.Expires) {
+			old.Expires = expires
+		}
+	} else {
+		old.Port, old.Revoked = 0, true
+	}
+	return *entry, s.save()
+}
+
+// 吊销token，不管是管理员创建的还是注册中心里的
+func (s *tokenStore) revoke(token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.entryLocked(token).Revoked = true
+	return s.save()
+}
+
+func (s *tokenStore) reserveLocked(token string, port int) error {
+	if port <= 0 || port > 65535 {
+		return errors.ErrFailedToListen
+	}
+	if entry, ok := s.tokens[token]; ok && !entry.allowsPort(port) {
+		return errors.ErrPermissionDenied
+	}
+	for _, entry := range s.tokens {
+		if entry.Port == port && entry.Token != token && entry.RotatedTo == "" {
+			return errors.ErrPortReserved
+		}
+	}
+
+	s.entryLocked(token).Port = port
+	return nil
+}
+
+// 给token预留公网端口，客户端下次连接时生效
+func (s *tokenStore) reserve(token string, port int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.reserveLocked(token, port); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// 取消端口预留，轮换前后的token都会预留同一个端口。只为预留端口而建的记录一起删掉
+func (s *tokenStore) release(port int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	found := false
+	for token, entry := range s.tokens {
+		if entry.Port != port {
+			continue
+		}
+		found = true
+		entry.Port = 0
+		if !entry.Local && !entry.Revoked && len(entry.Scopes) == 0 && entry.Expires.IsZero() {
+			delete(s.tokens, token)
+		}
+	}
+	if !found {
+		return errors.ErrPortNotReserved
+	}
+	return s.save()
+}
+
+// 返回轮换成token的旧token，没有时返回空
+func (s *tokenStore) rotatedFrom(token string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, entry := range s.tokens {
+		if entry.RotatedTo == token {
+			return entry.Token
+		}
+	}
+	return ""
+}
+
+// 检查token是否允许打开这种隧道、加入这个分组
+func (s *service) checkScopes(token string, options tunnelOptions, group string) error {
+	entry := s.tokens.get(token)
+	if err := entry.validate(time.Now()); err != nil {
+		return err
+	}
+
+	tunnelType := "tcp"
+	if options.http {
+		tunnelType = "http"
+	}
+	if !entry.allows(scopeTunnel, tunnelType) {
+		return errors.ErrPermissionDenied
+	}
+	if group != "" && !entry.allows(scopeGroup, group) {
+		return errors.ErrPermissionDenied
+	}
+	return nil
+}
+
+// 宽限期结束时马上踢掉旧token的会话，不用等checkSessions，新token的会话才能拿到端口
+func (s *service) expireRotated(token string) {
+	expires := s.tokens.get(token).Expires
+	if expires.IsZero() {
+		return
+	}
+
+	time.AfterFunc(time.Until(expires), func() {
+		entry := s.tokens.get(token)
+		if err := entry.validate(time.Now()); err != nil {
+			n := s.kick(KickRequest{Token: token}, err)
+			logger.Info("grace period of rotated token ended", "token", token, "kicked", n)
+		}
+	})
+}
+
+// 轮换token的宽限期内，旧token的会话还占着预留端口，等这些会话结束之后再监听，端口交给新token。
+// 宽限期可能很长，最多等rotatedWaitTimeout，之后让客户端稍后重试
+func (s *service) waitRotated(ctx context.Context, token string) error {
+	port := s.tokens.get(token).Port
+	old := s.tokens.rotatedFrom(token)
+	if port == 0 || old == "" {
+		return nil
+	}
+
+	timeout := time.NewTimer(rotatedWaitTimeout)
+	defer timeout.Stop()
+	for {
+		var holder *manager
+		s.lock.Lock()
+		for manager := range s.managers {
+			manager.listenerMu.Lock()
+			if manager.token == old && manager.wanListener != nil && listenerPort(manager.wanListener) == strconv.Itoa(port) {
+				holder = manager
+			}
+			manager.listenerMu.Unlock()
+		}
+		s.lock.Unlock()
+		if holder == nil {
+			return nil
+		}
+
+		logger.Info("waiting for the session of rotated token to release the port", "token", token, "port", port, "session", holder.id)
+		select {
+		case <-holder.stopCh:
+			// stopCh关闭之后会话才退出并关闭监听，稍等再检查
+			time.Sleep(time.Millisecond * 100)
+		case <-timeout.C:
+			return errors.ErrRotatedTokenOnline
+		case <-ctx.Done():
+			return errors.ErrCanceled
+		}
+	}
+}
+
+// 定期检查在线会话的token，吊销、过期或者注册中心不再认可的token踢掉。注册中心不可用时不踢
+func (s *service) checkSessions(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.lock.Lock()
+		managers := make([]*manager, 0, len(s.managers))
+		for manager := range s.managers {
+			managers = append(managers, manager)
+		}
+		s.lock.Unlock()
+
+		results := make(map[string]error)
+		now := time.Now()
+		for _, manager := range managers {
+			err, ok := results[manager.token]
+			if !ok {
+				entry := s.tokens.get(manager.token)
+				err = entry.validate(now)
+				if err == nil && !entry.Local {
+					if _, queryErr := tools.GetAddrByToken(manager.token); queryErr == errors.ErrTokenNotValid {
+						err = queryErr
+					}
+				}
+				results[manager.token] = err
+			}
+
+			if err != nil {
+				logger.Info("token of session is no longer valid", "session", manager.id, "token", manager.token, "error", err)
+				manager.kick(err)
+			}
+		}
+	}
+}
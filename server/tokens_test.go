@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jiajunhuang/natproxy/errors"
+)
+
+func TestTokenStoreRotate(t *testing.T) {
+	s, err := openTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.create("", 20001, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := s.rotate(old.Token, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Port != 20001 {
+		t.Errorf("new token got port %d, want 20001", entry.Port)
+	}
+	// 宽限期内旧token还能使用端口，端口属于新token
+	if s.get(old.Token).Port != 20001 {
+		t.Error("old token lost its port during grace period")
+	}
+	if s.reservedByOther(20001, entry.Token) {
+		t.Error("port is reserved by the rotated token")
+	}
+	if !s.reservedByOther(20001, "other") {
+		t.Error("port is not reserved for other tokens")
+	}
+	if from := s.rotatedFrom(entry.Token); from != old.Token {
+		t.Errorf("rotatedFrom = %q, want %q", from, old.Token)
+	}
+	if _, err := s.rotate(old.Token, 0); err != errors.ErrTokenRotated {
+		t.Errorf("rotate twice: %v", err)
+	}
+
+	// 轮换前后的token一起取消预留
+	if err := s.release(20001); err != nil {
+		t.Fatal(err)
+	}
+	if s.get(old.Token).Port != 0 || s.get(entry.Token).Port != 0 {
+		t.Error("port is still reserved after release")
+	}
+}
+
+func TestTokenStoreRegistryToken(t *testing.T) {
+	s, err := openTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 注册中心的token不能轮换，但是可以限制权限范围
+	if _, err := s.rotate("registry", time.Minute); err != errors.ErrNotSupport {
+		t.Errorf("rotate registry token: %v", err)
+	}
+	if _, err := s.update("registry", 0, []string{"tunnel:http"}); err != nil {
+		t.Fatal(err)
+	}
+	entry := s.get("registry")
+	if entry.Local || entry.allows(scopeTunnel, "tcp") || !entry.allows(scopeTunnel, "http") {
+		t.Errorf("scopes of registry token are not applied: %+v", entry)
+	}
+
+	// 有权限范围的记录在取消端口预留之后保留下来
+	if err := s.reserve("registry", 20002); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.release(20002); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.get("registry").Scopes) == 0 {
+		t.Error("scopes are dropped with the reserved port")
+	}
+}
+
+// 宽限期结束时旧token的会话被踢掉，新token的会话拿到端口
+func TestRotatedGraceExpired(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port, _ := strconv.Atoi(listenerPort(l))
+
+	svc := newService("127.0.0.1", 1)
+	if svc.tokens, err = openTokenStore(""); err != nil {
+		t.Fatal(err)
+	}
+	old, err := svc.tokens.create("", port, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := svc.tokens.rotate(old.Token, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder := newManager(svc, 1)
+	holder.token, holder.wanListener = old.Token, l
+	svc.managers[holder] = struct{}{}
+	go func() {
+		// 会话结束时关闭监听
+		<-holder.stopCh
+		svc.lock.Lock()
+		delete(svc.managers, holder)
+		svc.lock.Unlock()
+	}()
+
+	svc.expireRotated(old.Token)
+	start := time.Now()
+	if err := svc.waitRotated(context.Background(), entry.Token); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Errorf("waited %v for the rotated session", elapsed)
+	}
+	if holder.stopErr != errors.ErrTokenExpired {
+		t.Errorf("old session is kicked with %v", holder.stopErr)
+	}
+}